@@ -0,0 +1,197 @@
+package aliyunoss
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+	"github.com/pluveto/upgit/lib/xio"
+	"github.com/pluveto/upgit/lib/xprogress"
+	"github.com/pluveto/upgit/lib/xresume"
+)
+
+// minPartSize is the limit of OSS
+const minPartSize = 100 << 10
+
+// multipart keeps states of resumable multipart uploads to the bucket. Parts
+// are driven by oss sdk, so it has no xresume.Service.
+func (u *OSSUploader) multipart() xresume.Uploader {
+	return xresume.Uploader{
+		Name:     "aliyunoss",
+		Endpoint: u.Config.Endpoint,
+		Bucket:   u.Config.BucketName,
+		Sizing: xresume.Sizing{
+			ThresholdMB: u.Config.MultipartThresholdMB,
+			PartSizeMB:  u.Config.PartSizeMB,
+			Concurrency: u.Config.PartConcurrency,
+			MinPartSize: minPartSize,
+		},
+		Store: u.store,
+	}
+}
+
+// PutFileMultipart uploads a file in parallel parts. Finished parts are
+// recorded in a checkpoint file next to the upload state of stateId, so that
+// calling again, even from another process, continues the upload.
+func (u *OSSUploader) PutFileMultipart(ctx context.Context, stateId, localPath, targetPath string) (err error) {
+	file, size, err := xio.OpenFile(localPath)
+	if err != nil {
+		return err
+	}
+	file.Close()
+	tracker := xprogress.Start(ctx, size)
+	defer func() { tracker.Finish(err) }()
+
+	mp := u.multipart()
+	if stateId != "" {
+		// the upload id is kept by the checkpoint
+		if _, err = mp.Save(stateId, localPath, targetPath, ""); err != nil {
+			return err
+		}
+	}
+
+	// oss sdk doesn't pass context to part uploads, so bind it to the client
+	bucket, err := u.bucketWithClient(&http.Client{
+		Transport: contextTransport{ctx: ctx, base: u.Options.HTTPClient().Transport},
+		Timeout:   u.Options.HTTPClient().Timeout,
+	})
+	if err != nil {
+		return err
+	}
+	options := append(metadataOptions(u.Options.Metadata.Resolve(localPath)),
+		oss.WithContext(ctx),
+		oss.Routines(mp.Sizing.PartConcurrency()),
+		oss.Progress(fileProgressListener{tracker: tracker, size: size}),
+	)
+	if stateId != "" {
+		options = append(options, oss.Checkpoint(true, checkpointPath(mp.StateStore(), stateId)))
+	}
+	err = bucket.UploadFile(targetPath, localPath, mp.Sizing.PartSize(size), options...)
+	if err == nil && stateId != "" {
+		mp.Remove(stateId)
+	}
+	return err
+}
+
+// checkpointPath is where oss sdk records finished parts of upload stateId
+func checkpointPath(store xresume.Store, stateId string) string {
+	return filepath.Join(store.Dir, stateId+".oss.cp")
+}
+
+// AbortMultipart aborts unfinished multipart uploads saved on this machine,
+// or all the ones in bucket if all is set. It returns the aborted uploads.
+func (u OSSUploader) AbortMultipart(ctx context.Context, all bool) (aborted []string, err error) {
+	bucket, err := u.bucket()
+	if err != nil {
+		return nil, err
+	}
+	mp := u.multipart()
+	store := mp.StateStore()
+	states, err := mp.States()
+	if err != nil {
+		return nil, err
+	}
+	var uploads []oss.InitiateMultipartUploadResult
+	for id := range states {
+		// the upload id is only known by the checkpoint of oss sdk, missing
+		// if no part was started
+		cp, err := readCheckpoint(checkpointPath(store, id))
+		if err != nil {
+			return nil, err
+		}
+		if cp != nil && cp.UploadID != "" {
+			uploads = append(uploads, oss.InitiateMultipartUploadResult{Bucket: u.Config.BucketName, Key: cp.ObjectKey, UploadID: cp.UploadID})
+		}
+	}
+	if all {
+		uploads = nil
+		keyMarker, uploadIdMarker := "", ""
+		for {
+			page, err := bucket.ListMultipartUploads(oss.WithContext(ctx), oss.KeyMarker(keyMarker), oss.UploadIDMarker(uploadIdMarker))
+			if err != nil {
+				return nil, err
+			}
+			for _, up := range page.Uploads {
+				uploads = append(uploads, oss.InitiateMultipartUploadResult{Bucket: u.Config.BucketName, Key: up.Key, UploadID: up.UploadID})
+			}
+			if !page.IsTruncated {
+				break
+			}
+			keyMarker, uploadIdMarker = page.NextKeyMarker, page.NextUploadIDMarker
+		}
+	}
+	for _, up := range uploads {
+		err := bucket.AbortMultipartUpload(up, oss.WithContext(ctx))
+		var ossErr oss.ServiceError
+		if err != nil && !(errors.As(err, &ossErr) && ossErr.Code == "NoSuchUpload") {
+			return aborted, fmt.Errorf("abort %s: %w", up.Key, err)
+		}
+		aborted = append(aborted, up.Key+" ("+up.UploadID+")")
+	}
+	// states and checkpoints of aborted uploads are useless now
+	for id := range states {
+		if err := os.Remove(checkpointPath(store, id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return aborted, err
+		}
+		if err := mp.Remove(id); err != nil {
+			return aborted, err
+		}
+	}
+	return aborted, nil
+}
+
+// checkpoint is the part of a checkpoint file of oss sdk naming the upload
+type checkpoint struct {
+	ObjectKey string
+	UploadID  string
+}
+
+// readCheckpoint reads the checkpoint at path, or returns nil if there is none
+func readCheckpoint(path string) (*checkpoint, error) {
+	buf, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cp checkpoint
+	if err := json.Unmarshal(buf, &cp); err != nil {
+		return nil, fmt.Errorf("checkpoint %s: %w", path, err)
+	}
+	return &cp, nil
+}
+
+// fileProgressListener forwards progress of the whole file to tracker. The
+// sdk also reports progress of each part to the same listener, which is told
+// apart by its total.
+type fileProgressListener struct {
+	tracker *xprogress.Tracker
+	size    int64
+}
+
+func (l fileProgressListener) ProgressChanged(event *oss.ProgressEvent) {
+	if event.TotalBytes == l.size {
+		l.tracker.Set(event.ConsumedBytes)
+	}
+}
+
+// contextTransport sends every request within ctx
+type contextTransport struct {
+	ctx  context.Context
+	base http.RoundTripper
+}
+
+func (t contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(req.WithContext(t.ctx))
+}
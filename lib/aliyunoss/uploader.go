@@ -1,7 +1,10 @@
 package aliyunoss
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"os"
 	"path/filepath"
 	"time"
@@ -10,6 +13,9 @@ import (
 	"github.com/pluveto/upgit/lib/model"
 	"github.com/pluveto/upgit/lib/xapp"
 	"github.com/pluveto/upgit/lib/xlog"
+	"github.com/pluveto/upgit/lib/xprogress"
+	"github.com/pluveto/upgit/lib/xresume"
+	"github.com/pluveto/upgit/lib/xretry"
 )
 
 type OSSConfig struct {
@@ -18,13 +24,28 @@ type OSSConfig struct {
 	AccessKeySecret string `toml:"access_key_secret" mapstructure:"access_key_secret" validate:"nonzero"`
 	BucketName      string `toml:"bucket_name" mapstructure:"bucket_name" validate:"nonzero"`
 	Host            string `toml:"host" mapstructure:"host" validate:"nonzero"`
+	// SecurityToken is set when using temporary credentials from STS
+	SecurityToken string `toml:"security_token,omitempty" mapstructure:"security_token"`
+	// Files larger than MultipartThresholdMB are uploaded in parts of PartSizeMB,
+	// PartConcurrency at a time. Unfinished uploads are resumed on next run.
+	MultipartThresholdMB int64 `toml:"multipart_threshold_mb,omitempty" mapstructure:"multipart_threshold_mb"`
+	PartSizeMB           int64 `toml:"part_size_mb,omitempty" mapstructure:"part_size_mb"`
+	PartConcurrency      int   `toml:"part_concurrency,omitempty" mapstructure:"part_concurrency"`
 }
 
 type OSSUploader struct {
-	Config OSSConfig
+	Config  OSSConfig
+	Options xapp.UploaderOptions
+
+	// store keeps state of multipart uploads, xresume.DefaultStore() if not set
+	store xresume.Store
 }
 
 func (u OSSUploader) Upload(t *model.Task) error {
+	return u.UploadContext(context.Background(), t)
+}
+
+func (u OSSUploader) UploadContext(ctx context.Context, t *model.Task) error {
 	now := time.Now()
 	name := filepath.Base(t.LocalPath)
 	var targetPath string
@@ -33,10 +54,27 @@ func (u OSSUploader) Upload(t *model.Task) error {
 	} else {
 		targetPath = xapp.Rename(name, now)
 	}
+	multipart := false
+	var stateId string
+	if stat, err := os.Stat(t.LocalPath); err == nil && stat.Size() > u.multipart().Sizing.Threshold() {
+		multipart = true
+		stateId, targetPath = u.multipart().Resume(t.LocalPath, t.TargetDir, targetPath)
+	}
 	rawUrl := u.buildUrl(targetPath)
 	url := xapp.ReplaceUrl(rawUrl)
 	xlog.GVerbose.Info("uploading #TASK_%d %s\n", t.TaskId, t.LocalPath)
-	err := u.PutFile(t.LocalPath, targetPath)
+	attempts, err := xretry.Do(ctx, u.Options.Retry, func() error {
+		if multipart {
+			return classifyErr(u.PutFileMultipart(ctx, stateId, t.LocalPath, targetPath))
+		}
+		return classifyErr(u.PutFile(ctx, t.LocalPath, targetPath))
+	})
+	t.Attempts = attempts
+	if presigned, expire := u.Options.Presigned(); err == nil && presigned {
+		rawUrl, err = u.presign(targetPath, expire)
+		url = xapp.ReplaceUrl(rawUrl)
+		t.ExpireTime = time.Now().Add(expire)
+	}
 	if err == nil {
 		xlog.GVerbose.Info("successfully uploaded #TASK_%d %s => %s\n", t.TaskId, t.LocalPath, url)
 		t.Status = model.TASK_FINISHED
@@ -51,17 +89,55 @@ func (u OSSUploader) Upload(t *model.Task) error {
 	return err
 }
 
+// classifyErr tells xretry whether an error returned by oss sdk is retryable
+func classifyErr(err error) error {
+	var srvErr oss.ServiceError
+	if errors.As(err, &srvErr) {
+		return xretry.ClassifyStatus(srvErr.StatusCode, nil, nil, err)
+	}
+	return err
+}
+
+// progressListener forwards progress of oss sdk to tracker
+type progressListener struct {
+	tracker *xprogress.Tracker
+}
+
+func (l progressListener) ProgressChanged(event *oss.ProgressEvent) {
+	l.tracker.Set(event.ConsumedBytes)
+}
+
 func (u *OSSUploader) buildUrl(path string) string {
 	return fmt.Sprintf("%s/%s", u.Config.Host, path)
 }
 
-func (u *OSSUploader) PutFile(localPath, targetPath string) (err error) {
-	cli, err := oss.New(u.Config.Endpoint, u.Config.AccessKeyId, u.Config.AccessKeySecret)
+func (u *OSSUploader) bucket() (*oss.Bucket, error) {
+	return u.bucketWithClient(u.Options.HTTPClient())
+}
+
+func (u *OSSUploader) bucketWithClient(client *http.Client) (*oss.Bucket, error) {
+	options := []oss.ClientOption{oss.HTTPClient(client)}
+	if u.Config.SecurityToken != "" {
+		options = append(options, oss.SecurityToken(u.Config.SecurityToken))
+	}
+	cli, err := oss.New(u.Config.Endpoint, u.Config.AccessKeyId, u.Config.AccessKeySecret, options...)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return cli.Bucket(u.Config.BucketName)
+}
+
+// presign makes a url reading the object without credentials until it expires
+func (u *OSSUploader) presign(targetPath string, expire time.Duration) (string, error) {
+	bucket, err := u.bucket()
+	if err != nil {
+		return "", err
+	}
+	return bucket.SignURL(targetPath, oss.HTTPGet, int64(expire.Seconds()))
+}
 
-	bucket, err := cli.Bucket(u.Config.BucketName)
+func (u *OSSUploader) PutFile(ctx context.Context, localPath, targetPath string) (err error) {
+	bucket, err := u.bucket()
 	if err != nil {
 		return err
 	}
@@ -70,7 +146,43 @@ func (u *OSSUploader) PutFile(localPath, targetPath string) (err error) {
 	if err != nil {
 		return err
 	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	tracker := xprogress.Start(ctx, stat.Size())
+	defer func() { tracker.Finish(err) }()
 
-	err = bucket.PutObject(targetPath, file)
+	options := append(metadataOptions(u.Options.Metadata.Resolve(localPath)), oss.WithContext(ctx), oss.Progress(progressListener{tracker}))
+	err = bucket.PutObject(targetPath, file, options...)
 	return
 }
+
+// metadataOptions maps metadata onto oss headers
+func metadataOptions(meta model.ObjectMetadata) []oss.Option {
+	options := []oss.Option{oss.ContentType(meta.ContentType)}
+	if meta.CacheControl != "" {
+		options = append(options, oss.CacheControl(meta.CacheControl))
+	}
+	if meta.ContentDisposition != "" {
+		options = append(options, oss.ContentDisposition(meta.ContentDisposition))
+	}
+	if meta.StorageClass != "" {
+		options = append(options, oss.ObjectStorageClass(oss.StorageClassType(meta.StorageClass)))
+	}
+	if meta.ACL != "" {
+		options = append(options, oss.ObjectACL(oss.ACLType(meta.ACL)))
+	}
+	if len(meta.Tags) > 0 {
+		var tagging oss.Tagging
+		for k, v := range meta.Tags {
+			tagging.Tags = append(tagging.Tags, oss.Tag{Key: k, Value: v})
+		}
+		options = append(options, oss.SetTagging(tagging))
+	}
+	for k, v := range meta.Meta {
+		options = append(options, oss.Meta(k, v))
+	}
+	return options
+}
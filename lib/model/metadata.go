@@ -0,0 +1,102 @@
+package model
+
+import (
+	"mime"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// ObjectMetadata describes headers set on an uploaded object. Each cloud
+// uploader maps them onto its native headers. Empty fields are not sent.
+type ObjectMetadata struct {
+	CacheControl       string `toml:"cache_control,omitempty" mapstructure:"cache_control"`
+	ContentDisposition string `toml:"content_disposition,omitempty" mapstructure:"content_disposition"`
+	// ContentType is detected from file extension if not set
+	ContentType  string            `toml:"content_type,omitempty" mapstructure:"content_type"`
+	StorageClass string            `toml:"storage_class,omitempty" mapstructure:"storage_class"`
+	ACL          string            `toml:"acl,omitempty" mapstructure:"acl"`
+	Tags         map[string]string `toml:"tags,omitempty" mapstructure:"tags"`
+	// Meta is custom metadata, sent as x-amz-meta-*, x-oss-meta-* or x-cos-meta-*
+	Meta map[string]string `toml:"meta,omitempty" mapstructure:"meta"`
+}
+
+// MetadataOverride applies to files matching Pattern, a glob like "*.pdf".
+// A pattern containing "/" is matched against the whole local path.
+type MetadataOverride struct {
+	Pattern        string `toml:"pattern" mapstructure:"pattern"`
+	ObjectMetadata `mapstructure:",squash"`
+}
+
+// Metadata is the [uploaders.<id>.metadata] config block
+type Metadata struct {
+	ObjectMetadata `mapstructure:",squash"`
+	Overrides      []MetadataOverride `toml:"overrides,omitempty" mapstructure:"overrides"`
+}
+
+// Resolve returns metadata of given file. Matching overrides are applied in
+// order, later ones win.
+func (m Metadata) Resolve(localPath string) ObjectMetadata {
+	ret := m.ObjectMetadata.merge(ObjectMetadata{})
+	for _, o := range m.Overrides {
+		if o.match(localPath) {
+			ret = ret.merge(o.ObjectMetadata)
+		}
+	}
+	if ret.ContentType == "" {
+		ret.ContentType = mime.TypeByExtension(filepath.Ext(localPath))
+	}
+	if ret.ContentType == "" {
+		ret.ContentType = "application/octet-stream"
+	}
+	return ret
+}
+
+func (o MetadataOverride) match(localPath string) bool {
+	name := filepath.Base(localPath)
+	if strings.Contains(o.Pattern, "/") {
+		name = filepath.ToSlash(localPath)
+	}
+	ok, _ := filepath.Match(o.Pattern, name)
+	return ok
+}
+
+// merge returns m with fields set in other replacing its ones
+func (m ObjectMetadata) merge(other ObjectMetadata) ObjectMetadata {
+	set := func(dst *string, src string) {
+		if src != "" {
+			*dst = src
+		}
+	}
+	set(&m.CacheControl, other.CacheControl)
+	set(&m.ContentDisposition, other.ContentDisposition)
+	set(&m.ContentType, other.ContentType)
+	set(&m.StorageClass, other.StorageClass)
+	set(&m.ACL, other.ACL)
+	m.Tags = mergeMap(m.Tags, other.Tags)
+	m.Meta = mergeMap(m.Meta, other.Meta)
+	return m
+}
+
+func mergeMap(a, b map[string]string) map[string]string {
+	if len(a) == 0 && len(b) == 0 {
+		return nil
+	}
+	ret := make(map[string]string, len(a)+len(b))
+	for k, v := range a {
+		ret[k] = v
+	}
+	for k, v := range b {
+		ret[k] = v
+	}
+	return ret
+}
+
+// TagQuery encodes tags as a url query, the format of x-amz-tagging and alike
+func (m ObjectMetadata) TagQuery() string {
+	values := url.Values{}
+	for k, v := range m.Tags {
+		values.Set(k, v)
+	}
+	return values.Encode()
+}
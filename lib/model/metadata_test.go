@@ -0,0 +1,47 @@
+package model
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mitchellh/mapstructure"
+)
+
+func TestMetadataResolve(t *testing.T) {
+	cfg := map[string]interface{}{
+		"cache_control": "max-age=60",
+		"meta":          map[string]interface{}{"author": "me"},
+		"overrides": []interface{}{
+			map[string]interface{}{"pattern": "*.pdf", "content_disposition": "attachment", "meta": map[string]interface{}{"kind": "doc"}},
+			map[string]interface{}{"pattern": "docs/*/*.pdf", "cache_control": "no-cache"},
+		},
+	}
+	var m Metadata
+	if err := mapstructure.Decode(cfg, &m); err != nil {
+		t.Fatal(err)
+	}
+
+	got := m.Resolve("docs/2022/a.pdf")
+	want := ObjectMetadata{
+		CacheControl:       "no-cache",
+		ContentDisposition: "attachment",
+		ContentType:        "application/pdf",
+		Meta:               map[string]string{"author": "me", "kind": "doc"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Resolve() = %+v, want %+v", got, want)
+	}
+
+	got = m.Resolve("photo.unknownext")
+	want = ObjectMetadata{
+		CacheControl: "max-age=60",
+		ContentType:  "application/octet-stream",
+		Meta:         map[string]string{"author": "me"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Resolve() = %+v, want %+v", got, want)
+	}
+	if m.Meta["kind"] != "" {
+		t.Error("Resolve() modified config")
+	}
+}
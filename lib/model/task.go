@@ -20,6 +20,11 @@ type Task struct {
 	Ignored    bool         `toml:"ignored" mapstructure:"ignored"`
 	RawUrl     string       `toml:"raw_url" mapstructure:"raw_url"`
 	Url        string       `toml:"url" mapstructure:"url"`
+	Attempts   int          `toml:"attempts" mapstructure:"attempts"`
 	CreateTime time.Time    `toml:"create_time" mapstructure:"create_time"`
 	FinishTime time.Time    `toml:"finish_time" mapstructure:"finish_time"`
+	// ExpireTime is when a presigned url stops working. Zero for public urls
+	ExpireTime time.Time `toml:"expire_time" mapstructure:"expire_time"`
+	// Repo is the repository uploaded to, for uploaders that use several
+	Repo string `toml:"repo" mapstructure:"repo"`
 }
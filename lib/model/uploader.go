@@ -1,5 +1,31 @@
 package model
 
+import "context"
+
 type Uploader interface {
 	Upload(task *Task) error
 }
+
+// ContextUploader is an Uploader whose uploading can be cancelled through context
+type ContextUploader interface {
+	Uploader
+	UploadContext(ctx context.Context, task *Task) error
+}
+
+// BatchUploader stages each task in UploadContext and publishes all staged
+// ones at once in Flush, such as a single git commit. A staged task is not
+// done until Flush succeeds, while one finished without staging, like a file
+// identical to the remote one, is done already.
+type BatchUploader interface {
+	ContextUploader
+	// Flush publishes the staged tasks and returns them
+	Flush(ctx context.Context) (staged []*Task, err error)
+}
+
+// UploadContext uploads task with ctx if uploader supports it
+func UploadContext(ctx context.Context, uploader Uploader, task *Task) error {
+	if u, ok := uploader.(ContextUploader); ok {
+		return u.UploadContext(ctx, task)
+	}
+	return uploader.Upload(task)
+}
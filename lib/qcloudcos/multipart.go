@@ -0,0 +1,249 @@
+package qcloudcos
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/pluveto/upgit/lib/xapp"
+	"github.com/pluveto/upgit/lib/xlog"
+	"github.com/pluveto/upgit/lib/xresume"
+	"github.com/pluveto/upgit/lib/xretry"
+)
+
+// minPartSize is the limit of COS
+const minPartSize = 1 << 20
+
+// cosError is the error returned by COS api
+type cosError struct {
+	StatusCode int    `xml:"-"`
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *cosError) Error() string {
+	return fmt.Sprintf("cos error %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// multipart returns the resumable multipart uploader of the bucket
+func (u *COSUploader) multipart() xresume.Uploader {
+	return xresume.Uploader{
+		Name:     "qcloudcos",
+		Endpoint: u.host(),
+		Sizing: xresume.Sizing{
+			ThresholdMB: u.Config.MultipartThresholdMB,
+			PartSizeMB:  u.Config.PartSizeMB,
+			Concurrency: u.Config.PartConcurrency,
+			MinPartSize: minPartSize,
+		},
+		Store:   u.store,
+		Service: cosMultipart{u},
+	}
+}
+
+// PutFileMultipart uploads a file in parts, resuming the upload saved as
+// stateId if any
+func (u *COSUploader) PutFileMultipart(ctx context.Context, stateId, localPath, targetPath string) error {
+	return u.multipart().Put(ctx, stateId, localPath, targetPath)
+}
+
+// AbortMultipart aborts unfinished multipart uploads saved on this machine,
+// or all the ones in bucket if all is set. It returns the aborted uploads.
+func (u COSUploader) AbortMultipart(ctx context.Context, all bool) ([]string, error) {
+	return u.multipart().Abort(ctx, all)
+}
+
+// do sends a signed request to the bucket and decodes xml response into out
+// if it isn't nil
+func (u *COSUploader) do(ctx context.Context, method, key string, query url.Values, header http.Header, body io.Reader, length int64, out interface{}) (http.Header, error) {
+	url := u.buildUrl(urlfmt, key)
+	if len(query) > 0 {
+		// COS expects bare "uploads" rather than "uploads="
+		url += "?" + encodeQuery(query)
+	}
+	xlog.GVerbose.Trace("%s %s", method, url)
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.ContentLength = length
+	}
+	req.Host = u.host()
+	req.Header.Set("User-Agent", xapp.UserAgent)
+	resp, err := u.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		xlog.GVerbose.Trace("response body: " + string(respBody))
+		cosErr := &cosError{StatusCode: resp.StatusCode}
+		xml.Unmarshal(respBody, cosErr)
+		return nil, xretry.ClassifyStatus(resp.StatusCode, resp.Header, respBody, cosErr)
+	}
+	if out != nil {
+		if err := xml.Unmarshal(respBody, out); err != nil {
+			return nil, err
+		}
+	}
+	return resp.Header, nil
+}
+
+// encodeQuery is url.Values.Encode writing keys with empty values without "="
+func encodeQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	for _, k := range keys {
+		for _, v := range query[k] {
+			if buf.Len() > 0 {
+				buf.WriteByte('&')
+			}
+			buf.WriteString(url.QueryEscape(k))
+			if v != "" {
+				buf.WriteByte('=')
+				buf.WriteString(url.QueryEscape(v))
+			}
+		}
+	}
+	return buf.String()
+}
+
+func isNoSuchUpload(err error) bool {
+	var cosErr *cosError
+	return errors.As(err, &cosErr) && cosErr.Code == "NoSuchUpload"
+}
+
+// cosMultipart is the xresume.Service of COS
+type cosMultipart struct {
+	u *COSUploader
+}
+
+func (m cosMultipart) Create(ctx context.Context, localPath, key string) (string, error) {
+	header := http.Header{}
+	setMetadataHeader(header, m.u.Options.Metadata.Resolve(localPath))
+	var out struct {
+		UploadId string
+	}
+	_, err := m.u.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, header, nil, 0, &out)
+	return out.UploadId, err
+}
+
+func (m cosMultipart) ListParts(ctx context.Context, key, uploadId string) ([]xresume.Part, error) {
+	var parts []xresume.Part
+	marker := ""
+	for {
+		query := url.Values{"uploadId": {uploadId}}
+		if marker != "" {
+			query.Set("part-number-marker", marker)
+		}
+		var page struct {
+			Parts []struct {
+				PartNumber int
+				ETag       string
+				Size       int64
+			} `xml:"Part"`
+			IsTruncated          bool
+			NextPartNumberMarker string
+		}
+		_, err := m.u.do(ctx, http.MethodGet, key, query, nil, nil, 0, &page)
+		if isNoSuchUpload(err) {
+			return nil, xresume.ErrNoSuchUpload
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range page.Parts {
+			parts = append(parts, xresume.Part{Number: p.PartNumber, ETag: p.ETag, Size: p.Size})
+		}
+		if !page.IsTruncated || page.NextPartNumberMarker == "" {
+			return parts, nil
+		}
+		marker = page.NextPartNumberMarker
+	}
+}
+
+func (m cosMultipart) UploadPart(ctx context.Context, key, uploadId string, number int, body io.ReadSeeker, length int64) (string, error) {
+	query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadId}}
+	header, err := m.u.do(ctx, http.MethodPut, key, query, nil, body, length, nil)
+	if err != nil {
+		return "", err
+	}
+	return header.Get("ETag"), nil
+}
+
+func (m cosMultipart) Complete(ctx context.Context, key, uploadId string, parts []xresume.Part) error {
+	type completedPart struct {
+		PartNumber int
+		ETag       string
+	}
+	var complete struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}
+	for _, part := range parts {
+		complete.Parts = append(complete.Parts, completedPart{part.Number, part.ETag})
+	}
+	buf, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/xml")
+	_, err = m.u.do(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadId}}, header, bytes.NewReader(buf), int64(len(buf)), nil)
+	return err
+}
+
+func (m cosMultipart) ListUploads(ctx context.Context) ([]xresume.Upload, error) {
+	var uploads []xresume.Upload
+	query := url.Values{"uploads": {""}}
+	for {
+		var page struct {
+			Uploads []struct {
+				Key      string
+				UploadId string
+			} `xml:"Upload"`
+			IsTruncated        bool
+			NextKeyMarker      string
+			NextUploadIdMarker string
+		}
+		if _, err := m.u.do(ctx, http.MethodGet, "", query, nil, nil, 0, &page); err != nil {
+			return nil, err
+		}
+		for _, up := range page.Uploads {
+			uploads = append(uploads, xresume.Upload{Key: up.Key, UploadId: up.UploadId})
+		}
+		if !page.IsTruncated {
+			return uploads, nil
+		}
+		query.Set("key-marker", page.NextKeyMarker)
+		query.Set("upload-id-marker", page.NextUploadIdMarker)
+	}
+}
+
+func (m cosMultipart) Abort(ctx context.Context, key, uploadId string) error {
+	_, err := m.u.do(ctx, http.MethodDelete, key, url.Values{"uploadId": {uploadId}}, nil, nil, 0, nil)
+	if isNoSuchUpload(err) {
+		return nil
+	}
+	return err
+}
@@ -183,6 +183,29 @@ func AddAuthorizationHeader(secretID, secretKey string, sessionToken string, req
 	req.Header.Set("Authorization", auth)
 }
 
+// PresignURL 生成在 URL 参数中带有签名的 GET 请求 URL，expire 后过期
+func PresignURL(secretID, secretKey, sessionToken, rawURL string, expire time.Duration) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return "", err
+	}
+	auth := newAuthorization(secretID, secretKey, req, NewAuthTime(expire), true)
+	// 签名中的 & 和 = 保持原样，作为 URL 参数的分隔符
+	var params []string
+	for _, kv := range strings.Split(auth, "&") {
+		k, v, _ := strings.Cut(kv, "=")
+		params = append(params, k+"="+encodeURIComponent(v))
+	}
+	if len(sessionToken) > 0 {
+		params = append(params, "x-cos-security-token="+encodeURIComponent(sessionToken))
+	}
+	if req.URL.RawQuery != "" {
+		params = append([]string{req.URL.RawQuery}, params...)
+	}
+	req.URL.RawQuery = strings.Join(params, "&")
+	return req.URL.String(), nil
+}
+
 // calSignKey 计算 SignKey
 func calSignKey(secretKey, keyTime string) string {
 	digest := calHMACDigest(secretKey, keyTime, sha1SignAlgorithm)
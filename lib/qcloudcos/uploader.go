@@ -1,36 +1,67 @@
 package qcloudcos
 
 import (
-	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/base64"
-	"fmt"
+	"errors"
+	"io"
 	"io/ioutil"
-	"mime"
 	"net/http"
+	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/pluveto/upgit/lib/model"
 	"github.com/pluveto/upgit/lib/xapp"
+	"github.com/pluveto/upgit/lib/xio"
 	"github.com/pluveto/upgit/lib/xlog"
-	"github.com/pluveto/upgit/lib/xstrings"
+	"github.com/pluveto/upgit/lib/xprogress"
+	"github.com/pluveto/upgit/lib/xresume"
+	"github.com/pluveto/upgit/lib/xretry"
 )
 
 type COSConfig struct {
-	Host      string `toml:"host" mapstructure:"host"  validate:"nonzero"`
+	// Host is <BucketName-APPID>.cos.<Region>.myqcloud.com, derived from
+	// bucket and region if not set
+	Host      string `toml:"host" mapstructure:"host"`
+	Bucket    string `toml:"bucket" mapstructure:"bucket"`
+	Region    string `toml:"region" mapstructure:"region"`
 	SecretID  string `toml:"secret_id"   mapstructure:"secret_id"   validate:"nonzero"`
 	SecretKey string `toml:"secret_key"  mapstructure:"secret_key"  validate:"nonzero"`
+	// SessionToken is set when using temporary credentials from STS
+	SessionToken string `toml:"session_token,omitempty" mapstructure:"session_token"`
+	// Files larger than MultipartThresholdMB are uploaded in parts of PartSizeMB,
+	// PartConcurrency at a time. Unfinished uploads are resumed on next run.
+	MultipartThresholdMB int64 `toml:"multipart_threshold_mb,omitempty" mapstructure:"multipart_threshold_mb"`
+	PartSizeMB           int64 `toml:"part_size_mb,omitempty" mapstructure:"part_size_mb"`
+	PartConcurrency      int   `toml:"part_concurrency,omitempty" mapstructure:"part_concurrency"`
+}
+
+// Validate checks the bucket is given either by host or by bucket and region
+func (c COSConfig) Validate() error {
+	if c.Host == "" && (c.Bucket == "" || c.Region == "") {
+		return errors.New("qcloudcos: either host or bucket and region should be set")
+	}
+	return nil
 }
 
 type COSUploader struct {
-	Config COSConfig
+	Config  COSConfig
+	Options xapp.UploaderOptions
+
+	// store keeps state of multipart uploads, xresume.DefaultStore() if not set
+	store xresume.Store
 }
 
 var urlfmt = "https://{host}/{path}"
 
 func (u COSUploader) Upload(t *model.Task) error {
+	return u.UploadContext(context.Background(), t)
+}
+
+func (u COSUploader) UploadContext(ctx context.Context, t *model.Task) error {
 	now := time.Now()
 	name := filepath.Base(t.LocalPath)
 	var targetPath string
@@ -39,11 +70,27 @@ func (u COSUploader) Upload(t *model.Task) error {
 	} else {
 		targetPath = xapp.Rename(name, now)
 	}
+	multipart := false
+	var stateId string
+	if stat, err := os.Stat(t.LocalPath); err == nil && stat.Size() > u.multipart().Sizing.Threshold() {
+		multipart = true
+		stateId, targetPath = u.multipart().Resume(t.LocalPath, t.TargetDir, targetPath)
+	}
 	rawUrl := u.buildUrl(urlfmt, targetPath)
 	url := xapp.ReplaceUrl(rawUrl)
 	xlog.GVerbose.Info("uploading #TASK_%d %s\n", t.TaskId, t.LocalPath)
-	// var err error
-	err := u.PutFile(t.LocalPath, targetPath)
+	attempts, err := xretry.Do(ctx, u.Options.Retry, func() error {
+		if multipart {
+			return u.PutFileMultipart(ctx, stateId, t.LocalPath, targetPath)
+		}
+		return u.PutFile(ctx, t.LocalPath, targetPath)
+	})
+	t.Attempts = attempts
+	if presigned, expire := u.Options.Presigned(); err == nil && presigned {
+		rawUrl, err = PresignURL(u.Config.SecretID, u.Config.SecretKey, u.Config.SessionToken, u.buildUrl(urlfmt, targetPath), expire)
+		url = xapp.ReplaceUrl(rawUrl)
+		t.ExpireTime = time.Now().Add(expire)
+	}
 	if err == nil {
 		xlog.GVerbose.Info("sucessfully uploaded #TASK_%d %s => %s\n", t.TaskId, t.LocalPath, url)
 		t.Status = model.TASK_FINISHED
@@ -60,38 +107,70 @@ func (u COSUploader) Upload(t *model.Task) error {
 
 func (u *COSUploader) buildUrl(urlfmt, path string) string {
 	r := strings.NewReplacer(
-		// <BucketName-APPID>.cos.<Region>.myqcloud.com
-		"{host}", u.Config.Host,
+		"{host}", u.host(),
 		"{path}", path,
 	)
 	return r.Replace(urlfmt)
 }
 
-func (u *COSUploader) PutFile(localPath, targetPath string) (err error) {
+// host returns the host of bucket
+func (u *COSUploader) host() string {
+	if u.Config.Host != "" {
+		return u.Config.Host
+	}
+	return u.Config.Bucket + ".cos." + u.Config.Region + ".myqcloud.com"
+}
+
+// httpClient returns a client signing requests with credentials in config
+func (u *COSUploader) httpClient() *http.Client {
+	client := *u.Options.HTTPClient()
+	client.Transport = &AuthorizationTransport{
+		SecretID:     u.Config.SecretID,
+		SecretKey:    u.Config.SecretKey,
+		SessionToken: u.Config.SessionToken,
+		Transport:    client.Transport,
+	}
+	return &client
+}
+
+func (u *COSUploader) PutFile(ctx context.Context, localPath, targetPath string) (err error) {
 	// prepare body
 
 	// create request
 	url := u.buildUrl(urlfmt, targetPath)
 	xlog.GVerbose.Trace("PUT %s", url)
-	req, err := http.NewRequest("PUT", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "PUT", url, nil)
 	if err != nil {
 		return err
 	}
 	// set header
-	data, err := ioutil.ReadFile(localPath)
+	file, size, err := xio.OpenFile(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	// Content-MD5 is needed before sending, so the file is read twice
+	digest, err := calMD5Digest(file)
 	if err != nil {
 		return err
 	}
-	mimeType := mime.TypeByExtension(filepath.Ext(localPath))
-	req.Host = u.Config.Host
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	req.Host = u.host()
 	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
-	req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(calMD5Digest(data)))
-	req.Header.Set("Content-Type", xstrings.ValueOrDefault(mimeType, "application/octet-stream"))
+	req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(digest))
 	req.Header.Set("User-Agent", xapp.UserAgent)
+	setMetadataHeader(req.Header, u.Options.Metadata.Resolve(localPath))
 	// set body
-	req.Body = ioutil.NopCloser(bytes.NewBuffer(data))
+	tracker := xprogress.Start(ctx, size)
+	defer func() { tracker.Finish(err) }()
+	if size > 0 {
+		req.Body = ioutil.NopCloser(tracker.Reader(file))
+		req.ContentLength = size
+	}
 	// send request
-	resp, err := (&http.Client{Transport: &AuthorizationTransport{SecretID: u.Config.SecretID, SecretKey: u.Config.SecretKey}}).Do(req)
+	resp, err := u.httpClient().Do(req)
 
 	xlog.GVerbose.Trace("request header:")
 	xlog.GVerbose.TraceStruct(req.Header)
@@ -99,18 +178,36 @@ func (u *COSUploader) PutFile(localPath, targetPath string) (err error) {
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return err
 	}
-	// check status code
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("status code: %d, resp body: %s", resp.StatusCode, string(body))
+	return xretry.CheckResponse(resp, body)
+}
+
+// setMetadataHeader maps metadata onto cos headers
+func setMetadataHeader(header http.Header, meta model.ObjectMetadata) {
+	set := func(key, value string) {
+		if value != "" {
+			header.Set(key, value)
+		}
+	}
+	set("Content-Type", meta.ContentType)
+	set("Cache-Control", meta.CacheControl)
+	set("Content-Disposition", meta.ContentDisposition)
+	set("x-cos-storage-class", meta.StorageClass)
+	set("x-cos-acl", meta.ACL)
+	set("x-cos-tagging", meta.TagQuery())
+	for k, v := range meta.Meta {
+		set("x-cos-meta-"+k, v)
 	}
-	return
 }
-func calMD5Digest(msg []byte) []byte {
+
+func calMD5Digest(r io.Reader) ([]byte, error) {
 	m := md5.New()
-	m.Write(msg)
-	return m.Sum(nil)
+	if _, err := io.Copy(m, r); err != nil {
+		return nil, err
+	}
+	return m.Sum(nil), nil
 }
@@ -0,0 +1,49 @@
+package qiniu
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PutPolicy is the upload policy signed into an upload token.
+// See https://developer.qiniu.com/kodo/1206/put-policy
+type PutPolicy struct {
+	// Scope is "bucket" to insert new files only, or "bucket:key" to allow
+	// overwriting the key
+	Scope    string `json:"scope"`
+	Deadline int64  `json:"deadline"`
+}
+
+// sign returns the url safe base64 encoded HMAC-SHA1 of data
+func sign(secretKey string, data []byte) string {
+	h := hmac.New(sha1.New, []byte(secretKey))
+	h.Write(data)
+	return base64.URLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// UploadToken makes the token authorizing an upload with given policy
+func UploadToken(accessKey, secretKey string, policy PutPolicy) (string, error) {
+	buf, err := json.Marshal(policy)
+	if err != nil {
+		return "", err
+	}
+	encodedPolicy := base64.URLEncoding.EncodeToString(buf)
+	return accessKey + ":" + sign(secretKey, []byte(encodedPolicy)) + ":" + encodedPolicy, nil
+}
+
+// SignDownloadURL signs url of an object in a private bucket, which works
+// until deadline.
+// See https://developer.qiniu.com/kodo/1202/download-token
+func SignDownloadURL(accessKey, secretKey, url string, deadline time.Time) string {
+	sep := "?"
+	if strings.Contains(url, "?") {
+		sep = "&"
+	}
+	url += sep + "e=" + strconv.FormatInt(deadline.Unix(), 10)
+	return url + "&token=" + accessKey + ":" + sign(secretKey, []byte(url))
+}
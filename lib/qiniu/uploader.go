@@ -0,0 +1,214 @@
+package qiniu
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pluveto/upgit/lib/model"
+	"github.com/pluveto/upgit/lib/xapp"
+	"github.com/pluveto/upgit/lib/xhttp"
+	"github.com/pluveto/upgit/lib/xio"
+	"github.com/pluveto/upgit/lib/xlog"
+	"github.com/pluveto/upgit/lib/xprogress"
+	"github.com/pluveto/upgit/lib/xretry"
+)
+
+type QiniuConfig struct {
+	AccessKey string `toml:"access_key" mapstructure:"access_key" validate:"nonzero"`
+	SecretKey string `toml:"secret_key" mapstructure:"secret_key" validate:"nonzero"`
+	Bucket    string `toml:"bucket" mapstructure:"bucket" validate:"nonzero"`
+	// Region id of bucket like z0, z1, z2, na0, as0 or cn-east-2
+	Region string `toml:"region" mapstructure:"region"`
+	// UpHost overrides the upload host derived from region
+	UpHost string `toml:"up_host,omitempty" mapstructure:"up_host"`
+	// Domain bound to bucket, like https://cdn.example.com
+	Domain string `toml:"domain" mapstructure:"domain" validate:"nonzero"`
+	// Overwrite allows replacing an existing file of same key
+	Overwrite bool `toml:"overwrite,omitempty" mapstructure:"overwrite"`
+}
+
+type QiniuUploader struct {
+	Config  QiniuConfig
+	Options xapp.UploaderOptions
+}
+
+// tokenExpire is how long an upload token lives, longer than any upload should take
+const tokenExpire = 24 * time.Hour
+
+func (u QiniuUploader) Upload(t *model.Task) error {
+	return u.UploadContext(context.Background(), t)
+}
+
+func (u QiniuUploader) UploadContext(ctx context.Context, t *model.Task) error {
+	now := time.Now()
+	name := filepath.Base(t.LocalPath)
+	var targetPath string
+	if len(t.TargetDir) > 0 {
+		targetPath = t.TargetDir + "/" + name
+	} else {
+		targetPath = xapp.Rename(name, now)
+	}
+	rawUrl := u.buildUrl(targetPath)
+	xlog.GVerbose.Info("uploading #TASK_%d %s\n", t.TaskId, t.LocalPath)
+	attempts, err := xretry.Do(ctx, u.Options.Retry, func() error {
+		return u.PutFile(ctx, t.LocalPath, targetPath)
+	})
+	t.Attempts = attempts
+	if presigned, expire := u.Options.Presigned(); err == nil && presigned {
+		t.ExpireTime = time.Now().Add(expire)
+		rawUrl = SignDownloadURL(u.Config.AccessKey, u.Config.SecretKey, rawUrl, t.ExpireTime)
+	}
+	url := xapp.ReplaceUrl(rawUrl)
+	if err == nil {
+		xlog.GVerbose.Info("successfully uploaded #TASK_%d %s => %s\n", t.TaskId, t.LocalPath, url)
+		t.Status = model.TASK_FINISHED
+		t.Url = url
+		t.FinishTime = time.Now()
+		t.RawUrl = rawUrl
+	} else {
+		xlog.GVerbose.Info("failed to upload #TASK_%d %s : %s\n", t.TaskId, t.LocalPath, err.Error())
+		t.Status = model.TASK_FAILED
+		t.FinishTime = time.Now()
+	}
+	return err
+}
+
+func (u *QiniuUploader) buildUrl(key string) string {
+	domain := strings.TrimSuffix(u.Config.Domain, "/")
+	if !strings.Contains(domain, "://") {
+		domain = "https://" + domain
+	}
+	return domain + "/" + xhttp.EscapePath(key)
+}
+
+// upHost returns url of the upload host of bucket region
+func (u *QiniuUploader) upHost() string {
+	host := u.Config.UpHost
+	if host == "" {
+		switch u.Config.Region {
+		case "", "z0":
+			host = "upload.qiniup.com"
+		default:
+			host = "upload-" + u.Config.Region + ".qiniup.com"
+		}
+	}
+	if !strings.Contains(host, "://") {
+		host = "https://" + host
+	}
+	return host
+}
+
+func (u *QiniuUploader) uploadToken(key string) (string, error) {
+	policy := PutPolicy{
+		Scope:    u.Config.Bucket,
+		Deadline: time.Now().Add(tokenExpire).Unix(),
+	}
+	if u.Config.Overwrite {
+		policy.Scope += ":" + key
+	}
+	return UploadToken(u.Config.AccessKey, u.Config.SecretKey, policy)
+}
+
+func (u *QiniuUploader) PutFile(ctx context.Context, localPath, targetPath string) (err error) {
+	token, err := u.uploadToken(targetPath)
+	if err != nil {
+		return xretry.Fatal(err)
+	}
+	body, length, contentType, err := u.formBody(localPath, targetPath, token)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	tracker := xprogress.Start(ctx, length)
+	defer func() { tracker.Finish(err) }()
+
+	url := u.upHost()
+	xlog.GVerbose.Trace("POST %s", url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, tracker.ReadCloser(body))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = length
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", xapp.UserAgent)
+	resp, err := u.Options.HTTPClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	xlog.GVerbose.Trace("response body: " + string(respBody))
+	return checkResponse(resp, respBody)
+}
+
+// formBody builds the multipart form of an upload, streaming file content
+func (u *QiniuUploader) formBody(localPath, key, token string) (body io.ReadCloser, length int64, contentType string, err error) {
+	file, size, err := xio.OpenFile(localPath)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	meta := u.Options.Metadata.Resolve(localPath)
+
+	var head bytes.Buffer
+	w := multipart.NewWriter(&head)
+	w.WriteField("token", token)
+	w.WriteField("key", key)
+	for k, v := range meta.Meta {
+		w.WriteField("x-qn-meta-"+k, v)
+	}
+	partHeader := make(textproto.MIMEHeader)
+	partHeader.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename="%s"`, escapeQuotes(filepath.Base(localPath))))
+	// used as mime type of the file
+	partHeader.Set("Content-Type", meta.ContentType)
+	if _, err := w.CreatePart(partHeader); err != nil {
+		file.Close()
+		return nil, 0, "", err
+	}
+	headBytes := append([]byte(nil), head.Bytes()...)
+	head.Reset()
+	w.Close()
+	tail := head.Bytes()
+
+	length = int64(len(headBytes)) + size + int64(len(tail))
+	body = xio.MultiReadCloser(bytes.NewReader(headBytes), file, bytes.NewReader(tail))
+	return body, length, w.FormDataContentType(), nil
+}
+
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+func escapeQuotes(s string) string {
+	return quoteEscaper.Replace(s)
+}
+
+// checkResponse reads the error of a failed upload. Qiniu uses status codes
+// above 600 for errors like an existing file, which are not worth retrying.
+func checkResponse(resp *http.Response, body []byte) error {
+	if 200 <= resp.StatusCode && resp.StatusCode < 300 {
+		return nil
+	}
+	var ret struct {
+		Error string `json:"error"`
+	}
+	msg := string(body)
+	if json.Unmarshal(body, &ret) == nil && ret.Error != "" {
+		msg = ret.Error
+	}
+	err := fmt.Errorf("qiniu error %d: %s", resp.StatusCode, msg)
+	if resp.StatusCode >= 600 {
+		return xretry.Fatal(err)
+	}
+	return xretry.ClassifyStatus(resp.StatusCode, resp.Header, body, err)
+}
@@ -0,0 +1,145 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pluveto/upgit/lib/xresume"
+)
+
+// minPartSize is the limit of S3
+const minPartSize = 5 << 20
+
+// multipart returns the resumable multipart uploader of the bucket
+func (u *S3Uploader) multipart() xresume.Uploader {
+	return xresume.Uploader{
+		Name:     "s3",
+		Endpoint: u.Config.Endpoint,
+		Bucket:   u.Config.BucketName,
+		Sizing: xresume.Sizing{
+			ThresholdMB: u.Config.MultipartThresholdMB,
+			PartSizeMB:  u.Config.PartSizeMB,
+			Concurrency: u.Config.PartConcurrency,
+			MinPartSize: minPartSize,
+		},
+		Store:   u.store,
+		Service: s3Multipart{u},
+	}
+}
+
+// PutFileMultipart uploads a file in parts, resuming the upload saved as
+// stateId if any
+func (u *S3Uploader) PutFileMultipart(ctx context.Context, stateId, localPath, targetPath string) error {
+	return u.multipart().Put(ctx, stateId, localPath, targetPath)
+}
+
+// AbortMultipart aborts unfinished multipart uploads saved on this machine,
+// or all the ones in bucket if all is set. It returns the aborted uploads.
+func (u *S3Uploader) AbortMultipart(ctx context.Context, all bool) ([]string, error) {
+	return u.multipart().Abort(ctx, all)
+}
+
+// s3Multipart is the xresume.Service of S3
+type s3Multipart struct {
+	u *S3Uploader
+}
+
+func isNoSuchUpload(err error) bool {
+	var awsErr awserr.Error
+	return errors.As(err, &awsErr) && awsErr.Code() == s3.ErrCodeNoSuchUpload
+}
+
+func (m s3Multipart) Create(ctx context.Context, localPath, key string) (string, error) {
+	meta := m.u.Options.Metadata.Resolve(localPath)
+	out, err := m.u.s3Client.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:             aws.String(m.u.Config.BucketName),
+		Key:                aws.String(key),
+		ContentType:        aws.String(meta.ContentType),
+		CacheControl:       optional(meta.CacheControl),
+		ContentDisposition: optional(meta.ContentDisposition),
+		StorageClass:       optional(meta.StorageClass),
+		ACL:                optional(meta.ACL),
+		Tagging:            optional(meta.TagQuery()),
+		Metadata:           aws.StringMap(meta.Meta),
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(out.UploadId), nil
+}
+
+func (m s3Multipart) ListParts(ctx context.Context, key, uploadId string) ([]xresume.Part, error) {
+	var parts []xresume.Part
+	err := m.u.s3Client.ListPartsPagesWithContext(ctx, &s3.ListPartsInput{
+		Bucket:   aws.String(m.u.Config.BucketName),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadId),
+	}, func(page *s3.ListPartsOutput, lastPage bool) bool {
+		for _, p := range page.Parts {
+			parts = append(parts, xresume.Part{Number: int(aws.Int64Value(p.PartNumber)), ETag: aws.StringValue(p.ETag), Size: aws.Int64Value(p.Size)})
+		}
+		return true
+	})
+	if isNoSuchUpload(err) {
+		return nil, xresume.ErrNoSuchUpload
+	}
+	return parts, err
+}
+
+func (m s3Multipart) UploadPart(ctx context.Context, key, uploadId string, number int, body io.ReadSeeker, length int64) (string, error) {
+	out, err := m.u.s3Client.UploadPartWithContext(ctx, &s3.UploadPartInput{
+		Bucket:        aws.String(m.u.Config.BucketName),
+		Key:           aws.String(key),
+		UploadId:      aws.String(uploadId),
+		PartNumber:    aws.Int64(int64(number)),
+		Body:          body,
+		ContentLength: aws.Int64(length),
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(out.ETag), nil
+}
+
+func (m s3Multipart) Complete(ctx context.Context, key, uploadId string, parts []xresume.Part) error {
+	completed := make([]*s3.CompletedPart, len(parts))
+	for i, part := range parts {
+		completed[i] = &s3.CompletedPart{PartNumber: aws.Int64(int64(part.Number)), ETag: aws.String(part.ETag)}
+	}
+	_, err := m.u.s3Client.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(m.u.Config.BucketName),
+		Key:             aws.String(key),
+		UploadId:        aws.String(uploadId),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+	})
+	return err
+}
+
+func (m s3Multipart) ListUploads(ctx context.Context) ([]xresume.Upload, error) {
+	var uploads []xresume.Upload
+	err := m.u.s3Client.ListMultipartUploadsPagesWithContext(ctx, &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(m.u.Config.BucketName),
+	}, func(page *s3.ListMultipartUploadsOutput, lastPage bool) bool {
+		for _, up := range page.Uploads {
+			uploads = append(uploads, xresume.Upload{Key: aws.StringValue(up.Key), UploadId: aws.StringValue(up.UploadId)})
+		}
+		return true
+	})
+	return uploads, err
+}
+
+func (m s3Multipart) Abort(ctx context.Context, key, uploadId string) error {
+	_, err := m.u.s3Client.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(m.u.Config.BucketName),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadId),
+	})
+	if isNoSuchUpload(err) {
+		return nil
+	}
+	return err
+}
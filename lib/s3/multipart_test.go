@@ -0,0 +1,106 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pluveto/upgit/lib/xapp"
+	"github.com/pluveto/upgit/lib/xprogress"
+	"github.com/pluveto/upgit/lib/xresume"
+)
+
+// cancelAfter cancels uploading once given bytes are sent
+type cancelAfter struct {
+	bytes  int64
+	cancel context.CancelFunc
+}
+
+func (c *cancelAfter) Report(e xprogress.Event) {
+	if e.Sent >= c.bytes {
+		c.cancel()
+	}
+}
+
+// TestMultipartResume runs against a S3 compatible server such as MinIO:
+//
+//	minio server /tmp/data
+//	UPGIT_TEST_S3_ENDPOINT=http://127.0.0.1:9000 UPGIT_TEST_S3_BUCKET=test \
+//	UPGIT_TEST_S3_ACCESS_KEY=minioadmin UPGIT_TEST_S3_SECRET_KEY=minioadmin go test ./lib/s3/
+func TestMultipartResume(t *testing.T) {
+	endpoint := os.Getenv("UPGIT_TEST_S3_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("UPGIT_TEST_S3_ENDPOINT not set")
+	}
+	u, err := NewS3Uploader(S3Config{
+		Region:               "us-east-1",
+		BucketName:           os.Getenv("UPGIT_TEST_S3_BUCKET"),
+		AccessKey:            os.Getenv("UPGIT_TEST_S3_ACCESS_KEY"),
+		SecretKey:            os.Getenv("UPGIT_TEST_S3_SECRET_KEY"),
+		Endpoint:             endpoint,
+		MultipartThresholdMB: 1,
+		PartSizeMB:           5,
+		PartConcurrency:      1,
+	}, xapp.UploaderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	u.store = xresume.Store{Dir: filepath.Join(dir, "resume")}
+	xprogress.ReportInterval = 0
+
+	data := make([]byte, 12<<20)
+	rand.Read(data)
+	localPath := filepath.Join(dir, "big.bin")
+	if err := ioutil.WriteFile(localPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	stateId, key := u.multipart().Resume(localPath, "upgit-test", "upgit-test/big.bin")
+
+	// stop after the first part
+	ctx, cancel := context.WithCancel(context.Background())
+	reporter := &cancelAfter{bytes: 5 << 20, cancel: cancel}
+	err = u.PutFileMultipart(xprogress.WithReporter(ctx, reporter), stateId, localPath, key)
+	if err == nil {
+		t.Fatal("upload should be interrupted")
+	}
+	state, err := u.store.Load(stateId)
+	if err != nil || state == nil || len(state.Parts) == 0 {
+		t.Fatalf("state not saved: %v, %v", state, err)
+	}
+
+	// resume
+	uploadedParts := 0
+	u.s3Client.Handlers.Send.PushBack(func(r *request.Request) {
+		if r.Operation.Name == "UploadPart" {
+			uploadedParts++
+		}
+	})
+	err = u.PutFileMultipart(context.Background(), stateId, localPath, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 3 - len(state.Parts); uploadedParts != want {
+		t.Errorf("resumed upload sent %d parts, want %d", uploadedParts, want)
+	}
+	if state, _ := u.store.Load(stateId); state != nil {
+		t.Error("state should be removed after completion")
+	}
+
+	out, err := u.s3Client.GetObject(&s3.GetObjectInput{Bucket: aws.String(u.Config.BucketName), Key: aws.String(key)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Body.Close()
+	got, _ := ioutil.ReadAll(out.Body)
+	if !bytes.Equal(got, data) {
+		t.Error("uploaded content differs")
+	}
+}
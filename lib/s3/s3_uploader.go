@@ -1,36 +1,84 @@
 package s3
 
 import (
-	"mime"
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/pluveto/upgit/lib/model"
 	"github.com/pluveto/upgit/lib/xapp"
+	"github.com/pluveto/upgit/lib/xhttp"
 	"github.com/pluveto/upgit/lib/xlog"
+	"github.com/pluveto/upgit/lib/xprogress"
+	"github.com/pluveto/upgit/lib/xresume"
+	"github.com/pluveto/upgit/lib/xretry"
+	"github.com/pluveto/upgit/lib/xstrings"
 )
 
 type S3Config struct {
-	Region     string `toml:"region" mapstructure:"region" validate:"nonzero"`
+	// Region can be left empty to follow AWS_REGION or the profile
+	Region     string `toml:"region" mapstructure:"region"`
 	BucketName string `toml:"bucket_name" mapstructure:"bucket_name" validate:"nonzero"`
-	AccessKey  string `toml:"access_key" mapstructure:"access_key" validate:"nonzero"`
-	SecretKey  string `toml:"secret_key" mapstructure:"secret_key" validate:"nonzero"`
-	Endpoint   string `toml:"endpoint" mapstructure:"endpoint" validate:"nonzero"`
-	UrlFormat  string `toml:"url_format" mapstructure:"url_format" validate:"nonzero" default:"{endpoint}/{bucket}/{path}"`
+	// Endpoint can be left empty for AWS, which is resolved from region
+	Endpoint string `toml:"endpoint" mapstructure:"endpoint"`
+	// AddressingStyle is path, virtual or auto. auto uses virtual-hosted
+	// style for AWS, and path style for other S3 compatible services
+	AddressingStyle string `toml:"addressing_style,omitempty" mapstructure:"addressing_style"`
+	// UrlFormat defaults to the url of object in the addressing style
+	UrlFormat string `toml:"url_format" mapstructure:"url_format"`
+
+	// Static credentials. When not set, credentials are searched the way of
+	// aws cli: env vars, then Profile in ~/.aws/config and ~/.aws/credentials,
+	// which may use credential_process, web identity, sso or assume a role.
+	AccessKey    string `toml:"access_key" mapstructure:"access_key"`
+	SecretKey    string `toml:"secret_key" mapstructure:"secret_key"`
+	SessionToken string `toml:"session_token,omitempty" mapstructure:"session_token"`
+	Profile      string `toml:"profile,omitempty" mapstructure:"profile"`
+	// RoleArn is assumed with the credentials above
+	RoleArn         string `toml:"role_arn,omitempty" mapstructure:"role_arn"`
+	RoleSessionName string `toml:"role_session_name,omitempty" mapstructure:"role_session_name"`
+	ExternalId      string `toml:"external_id,omitempty" mapstructure:"external_id"`
+
+	// files larger than the threshold are uploaded in parts, which can be resumed
+	MultipartThresholdMB int64 `toml:"multipart_threshold_mb,omitempty" mapstructure:"multipart_threshold_mb"`
+	PartSizeMB           int64 `toml:"part_size_mb,omitempty" mapstructure:"part_size_mb"`
+	PartConcurrency      int   `toml:"part_concurrency,omitempty" mapstructure:"part_concurrency"`
 }
 
 type S3Uploader struct {
 	Config   S3Config
+	Options  xapp.UploaderOptions
 	s3Client *s3.S3
+	store    xresume.Store
+	// resolved from config
+	endpoint  *url.URL
+	region    string
+	pathStyle bool
 }
 
+const (
+	AddressingPath    = "path"
+	AddressingVirtual = "virtual"
+	AddressingAuto    = "auto"
+)
+
 func (u S3Uploader) Upload(t *model.Task) error {
+	return u.UploadContext(context.Background(), t)
+}
+
+func (u S3Uploader) UploadContext(ctx context.Context, t *model.Task) error {
 	now := time.Now()
 	name := filepath.Base(t.LocalPath)
 	var targetPath string
@@ -39,11 +87,28 @@ func (u S3Uploader) Upload(t *model.Task) error {
 	} else {
 		targetPath = xapp.Rename(name, now)
 	}
-	rawUrl := u.buildUrl(u.Config.UrlFormat, targetPath)
+	multipart := false
+	var stateId string
+	if stat, err := os.Stat(t.LocalPath); err == nil && stat.Size() > u.multipart().Sizing.Threshold() {
+		multipart = true
+		stateId, targetPath = u.multipart().Resume(t.LocalPath, t.TargetDir, targetPath)
+	}
+	rawUrl := u.buildUrl(targetPath)
 	url := xapp.ReplaceUrl(rawUrl)
 	xlog.GVerbose.Info("uploading #TASK_%d %s\n", t.TaskId, t.LocalPath)
 
-	err := u.PutFile(t.LocalPath, targetPath)
+	attempts, err := xretry.Do(ctx, u.Options.Retry, func() error {
+		if multipart {
+			return classifyErr(u.PutFileMultipart(ctx, stateId, t.LocalPath, targetPath))
+		}
+		return classifyErr(u.PutFile(ctx, t.LocalPath, targetPath))
+	})
+	t.Attempts = attempts
+	if presigned, expire := u.Options.Presigned(); err == nil && presigned {
+		rawUrl, err = u.presign(targetPath, expire)
+		url = xapp.ReplaceUrl(rawUrl)
+		t.ExpireTime = time.Now().Add(expire)
+	}
 	if err == nil {
 		xlog.GVerbose.Info("successfully uploaded #TASK_%d %s => %s\n", t.TaskId, t.LocalPath, url)
 		t.Status = model.TASK_FINISHED
@@ -58,51 +123,194 @@ func (u S3Uploader) Upload(t *model.Task) error {
 	return err
 }
 
-func (u *S3Uploader) buildUrl(urlfmt, path string) string {
+// buildUrl replaces placeholders of url_format with values of given key.
+// {path} and {key} are raw key while {key_escaped} is percent-encoded.
+// {bucket_host} is the virtual-hosted style host like bucket.s3.amazonaws.com
+func (u *S3Uploader) buildUrl(key string) string {
+	urlfmt := u.Config.UrlFormat
+	if urlfmt == "" {
+		urlfmt = "{endpoint}/{bucket}/{key_escaped}"
+		if !u.pathStyle {
+			urlfmt = "{scheme}://{bucket_host}/{key_escaped}"
+		}
+	}
 	r := strings.NewReplacer(
 		"{bucket}", u.Config.BucketName,
-		"{endpoint}", u.Config.Endpoint,
-		"{path}", path,
+		"{endpoint}", strings.TrimSuffix(u.endpoint.String(), "/"),
+		"{scheme}", u.endpoint.Scheme,
+		"{region}", u.region,
+		"{bucket_host}", u.Config.BucketName+"."+u.endpoint.Host,
+		"{path}", key,
+		"{key}", key,
+		"{key_escaped}", xhttp.EscapePath(key),
 	)
 	return r.Replace(urlfmt)
 }
 
-func (u *S3Uploader) PutFile(localPath, targetPath string) error {
+// resolveEndpoint returns url of endpoint in config, or the one of AWS in region
+func resolveEndpoint(endpoint, region string) (*url.URL, error) {
+	if endpoint == "" {
+		if region == "" {
+			return nil, errors.New("either endpoint or region should be set")
+		}
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	return url.Parse(endpoint)
+}
+
+// usePathStyle resolves addressing style of the bucket at endpoint
+func usePathStyle(style string, endpoint *url.URL, bucket string) (bool, error) {
+	switch style {
+	case AddressingPath:
+		return true, nil
+	case AddressingVirtual:
+		return false, nil
+	case AddressingAuto, "":
+		// buckets with dots can't be used in virtual-hosted style over https
+		isAWS := strings.HasSuffix(endpoint.Hostname(), ".amazonaws.com")
+		return !isAWS || strings.Contains(bucket, "."), nil
+	default:
+		return false, fmt.Errorf("unknown addressing_style %q, supports %s, %s and %s", style, AddressingPath, AddressingVirtual, AddressingAuto)
+	}
+}
+
+// presign makes a url reading the object without credentials until it expires
+func (u *S3Uploader) presign(targetPath string, expire time.Duration) (string, error) {
+	req, _ := u.s3Client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(u.Config.BucketName),
+		Key:    aws.String(targetPath),
+	})
+	return req.Presign(expire)
+}
+
+func (u *S3Uploader) PutFile(ctx context.Context, localPath, targetPath string) (err error) {
 	file, err := os.Open(localPath)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
-
-	// Detect the MIME type based on the file extension
-	ext := filepath.Ext(localPath)
-	mimeType := mime.TypeByExtension(ext)
-	if mimeType == "" {
-		mimeType = "application/octet-stream" // Default to binary/octet-stream if detection fails
+	stat, err := file.Stat()
+	if err != nil {
+		return err
 	}
+	tracker := xprogress.Start(ctx, stat.Size())
+	defer func() { tracker.Finish(err) }()
 
-	_, err = u.s3Client.PutObject(&s3.PutObjectInput{
-		Bucket:      aws.String(u.Config.BucketName),
-		Key:         aws.String(targetPath),
-		Body:        file,
-		ContentType: aws.String(mimeType),
+	meta := u.Options.Metadata.Resolve(localPath)
+	_, err = u.s3Client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:             aws.String(u.Config.BucketName),
+		Key:                aws.String(targetPath),
+		Body:               tracker.ReadSeeker(file),
+		ContentType:        aws.String(meta.ContentType),
+		CacheControl:       optional(meta.CacheControl),
+		ContentDisposition: optional(meta.ContentDisposition),
+		StorageClass:       optional(meta.StorageClass),
+		ACL:                optional(meta.ACL),
+		Tagging:            optional(meta.TagQuery()),
+		Metadata:           aws.StringMap(meta.Meta),
 	})
 	return err
 }
 
-func NewS3Uploader(config S3Config) (*S3Uploader, error) {
-	sess, err := session.NewSession(&aws.Config{
-		Region:           aws.String(config.Region),
-		Endpoint:         aws.String(config.Endpoint),
-		Credentials:      credentials.NewStaticCredentials(config.AccessKey, config.SecretKey, ""),
-		S3ForcePathStyle: aws.Bool(true), // Required for some S3-compatible services
-	})
+// optional returns nil for empty s, so that the header is not sent
+func optional(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return aws.String(s)
+}
+
+// classifyErr tells xretry whether an error returned by aws sdk is retryable
+func classifyErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) {
+		return xretry.ClassifyStatus(reqErr.StatusCode(), nil, nil, err)
+	}
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && awsErr.Code() == request.CanceledErrorCode {
+		return xretry.Fatal(err)
+	}
+	if errors.As(err, &awsErr) && awsErr.Code() == request.ErrCodeRequestError {
+		return xretry.Retryable(err, 0)
+	}
+	return err
+}
+
+func NewS3Uploader(config S3Config, opts xapp.UploaderOptions) (*S3Uploader, error) {
+	sess, err := newSession(config, opts)
 	if err != nil {
 		return nil, err
 	}
 
+	region := aws.StringValue(sess.Config.Region)
+	if region == "" {
+		// the sdk would fail only at the first request
+		return nil, errors.New("region is not set in config, AWS_REGION or profile. S3 compatible services usually take any one, like us-east-1 or auto")
+	}
+	endpoint, err := resolveEndpoint(config.Endpoint, region)
+	if err != nil {
+		return nil, err
+	}
+	pathStyle, err := usePathStyle(config.AddressingStyle, endpoint, config.BucketName)
+	if err != nil {
+		return nil, err
+	}
+
+	// endpoint is given to s3 client only, sts and sso keep their own ones
+	s3Cfg := &aws.Config{S3ForcePathStyle: aws.Bool(pathStyle)}
+	if config.Endpoint != "" {
+		s3Cfg.Endpoint = aws.String(endpoint.String())
+	}
 	return &S3Uploader{
-		Config:   config,
-		s3Client: s3.New(sess),
+		Config:    config,
+		Options:   opts,
+		s3Client:  s3.New(sess, s3Cfg),
+		store:     xresume.DefaultStore(),
+		endpoint:  endpoint,
+		region:    region,
+		pathStyle: pathStyle,
 	}, nil
 }
+
+// newSession creates a session with static credentials of config, or the
+// ones found by default credential chain of aws sdk
+func newSession(config S3Config, opts xapp.UploaderOptions) (*session.Session, error) {
+	if (config.AccessKey == "") != (config.SecretKey == "") {
+		return nil, errors.New("access_key and secret_key should be set together")
+	}
+	awsCfg := aws.Config{
+		HTTPClient: opts.HTTPClient(),
+		MaxRetries: aws.Int(0), // Retried by xretry
+	}
+	if config.Region != "" {
+		awsCfg.Region = aws.String(config.Region)
+	}
+	if config.AccessKey != "" {
+		awsCfg.Credentials = credentials.NewStaticCredentials(config.AccessKey, config.SecretKey, config.SessionToken)
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            awsCfg,
+		Profile:           config.Profile,
+		SharedConfigState: session.SharedConfigEnable,
+		// asks for mfa token of profile on terminal
+		AssumeRoleTokenProvider: stscreds.StdinTokenProvider,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if config.RoleArn != "" {
+		sess.Config.Credentials = stscreds.NewCredentials(sess, config.RoleArn, func(p *stscreds.AssumeRoleProvider) {
+			p.RoleSessionName = xstrings.ValueOrDefault(config.RoleSessionName, "upgit")
+			if config.ExternalId != "" {
+				p.ExternalID = aws.String(config.ExternalId)
+			}
+		})
+	}
+	return sess, nil
+}
@@ -0,0 +1,65 @@
+package s3
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/pluveto/upgit/lib/xapp"
+)
+
+func TestBuildUrl(t *testing.T) {
+	tests := []struct {
+		name   string
+		config S3Config
+		want   string
+	}{
+		{
+			name:   "aws virtual-hosted",
+			config: S3Config{Region: "us-west-2", BucketName: "my-bucket"},
+			want:   "https://my-bucket.s3.us-west-2.amazonaws.com/a%20dir/%E5%9B%BE%E7%89%87%201.png",
+		},
+		{
+			name:   "aws bucket with dots",
+			config: S3Config{Region: "us-west-2", BucketName: "my.bucket"},
+			want:   "https://s3.us-west-2.amazonaws.com/my.bucket/a%20dir/%E5%9B%BE%E7%89%87%201.png",
+		},
+		{
+			name:   "minio",
+			config: S3Config{Region: "us-east-1", BucketName: "test", Endpoint: "http://127.0.0.1:9000"},
+			want:   "http://127.0.0.1:9000/test/a%20dir/%E5%9B%BE%E7%89%87%201.png",
+		},
+		{
+			name:   "forced virtual",
+			config: S3Config{Region: "auto", BucketName: "test", Endpoint: "https://acc.r2.cloudflarestorage.com", AddressingStyle: AddressingVirtual},
+			want:   "https://test.acc.r2.cloudflarestorage.com/a%20dir/%E5%9B%BE%E7%89%87%201.png",
+		},
+		{
+			name:   "custom domain",
+			config: S3Config{Region: "auto", BucketName: "test", Endpoint: "https://acc.r2.cloudflarestorage.com", UrlFormat: "https://cdn.example.com/{key_escaped}?r={region}&raw={path}"},
+			want:   "https://cdn.example.com/a%20dir/%E5%9B%BE%E7%89%87%201.png?r=auto&raw=a dir/图片 1.png",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := NewS3Uploader(tt.config, xapp.UploaderOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := u.buildUrl("a dir/图片 1.png"); got != tt.want {
+				t.Errorf("buildUrl() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewS3UploaderWithoutRegion(t *testing.T) {
+	for _, env := range []string{"AWS_REGION", "AWS_DEFAULT_REGION", "AWS_PROFILE"} {
+		t.Setenv(env, "")
+	}
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "credentials"))
+	_, err := NewS3Uploader(S3Config{BucketName: "test", Endpoint: "http://127.0.0.1:9000"}, xapp.UploaderOptions{})
+	if err == nil {
+		t.Fatal("want error for missing region")
+	}
+}
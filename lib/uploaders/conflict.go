@@ -0,0 +1,101 @@
+package uploaders
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/pluveto/upgit/lib/xgit"
+	"github.com/pluveto/upgit/lib/xretry"
+)
+
+// Policies of uploading to a path already taken in a git repository
+const (
+	// ConflictFail fails on any existing file
+	ConflictFail = "fail"
+	// ConflictOverwrite replaces an existing file
+	ConflictOverwrite = "overwrite"
+	// ConflictRename uploads to a free path like name_1.png instead
+	ConflictRename = "rename"
+	// ConflictSkip reuses an identical file and fails on a different one
+	ConflictSkip = "skip"
+)
+
+// DefaultConflictPolicy keeps repeated uploads of a file working, while never
+// reporting a link to other content
+const DefaultConflictPolicy = ConflictSkip
+
+// maxRenames limits candidates tried by ConflictRename
+const maxRenames = 100
+
+func validConflictPolicy(policy string) error {
+	switch policy {
+	case "", ConflictFail, ConflictOverwrite, ConflictRename, ConflictSkip:
+		return nil
+	}
+	return errors.New("unknown on_conflict " + policy)
+}
+
+// remoteStat returns git blob sha of the file at path in repository, or ""
+// if there is none
+type remoteStat func(ctx context.Context, path string) (sha string, err error)
+
+// conflict is the decision made for uploading to a path
+type conflict struct {
+	// Path to upload to
+	Path string
+	// Sha of the existing file at Path, needed to replace it
+	Sha string
+	// Identical tells the file at Path has the same content, so that
+	// uploading is not needed
+	Identical bool
+}
+
+// resolveConflict decides where and whether to upload file at localPath
+// according to policy
+func resolveConflict(ctx context.Context, policy, localPath, targetPath string, stat remoteStat) (c conflict, err error) {
+	// local sha is computed only once a file is found
+	var localSha string
+	identical := func(remoteSha string) (bool, error) {
+		if localSha == "" {
+			sha, err := xgit.BlobSHA(localPath)
+			if err != nil {
+				return false, err
+			}
+			localSha = sha
+		}
+		return remoteSha == localSha, nil
+	}
+
+	c.Path = targetPath
+	for i := 1; ; i++ {
+		if c.Sha, err = stat(ctx, c.Path); err != nil || c.Sha == "" {
+			return c, err
+		}
+		if policy == ConflictFail {
+			return c, xretry.Fatal(fmt.Errorf("%s already exists", c.Path))
+		}
+		if c.Identical, err = identical(c.Sha); err != nil || c.Identical {
+			return c, err
+		}
+		switch policy {
+		case ConflictOverwrite:
+			return c, nil
+		case ConflictRename:
+			if i > maxRenames {
+				return c, xretry.Fatal(fmt.Errorf("no free path like %s", targetPath))
+			}
+			c.Path = renamed(targetPath, i)
+		default:
+			return c, xretry.Fatal(fmt.Errorf("%s already exists with different content", c.Path))
+		}
+	}
+}
+
+// renamed adds suffix _n to file name of p, keeping its extension
+func renamed(p string, n int) string {
+	ext := path.Ext(p)
+	return fmt.Sprintf("%s_%d%s", strings.TrimSuffix(p, ext), n, ext)
+}
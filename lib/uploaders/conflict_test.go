@@ -0,0 +1,50 @@
+package uploaders
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveConflict(t *testing.T) {
+	localPath := filepath.Join(t.TempDir(), "a.txt")
+	if err := ioutil.WriteFile(localPath, []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	const same = "ce013625030ba8dba906f756967f9e9ca394464a"
+	remote := map[string]string{"same.txt": same, "diff.txt": "1", "diff_1.txt": "2", "diff_2.txt": same}
+	stat := func(ctx context.Context, path string) (string, error) {
+		return remote[path], nil
+	}
+
+	tests := []struct {
+		policy, path string
+		want         conflict
+		wantErr      bool
+	}{
+		{ConflictSkip, "new.txt", conflict{Path: "new.txt"}, false},
+		{ConflictSkip, "same.txt", conflict{Path: "same.txt", Sha: same, Identical: true}, false},
+		{ConflictSkip, "diff.txt", conflict{}, true},
+		{ConflictFail, "same.txt", conflict{}, true},
+		{ConflictOverwrite, "diff.txt", conflict{Path: "diff.txt", Sha: "1"}, false},
+		{ConflictRename, "diff.txt", conflict{Path: "diff_2.txt", Sha: same, Identical: true}, false},
+		{ConflictRename, "dir.v2/diff", conflict{Path: "dir.v2/diff"}, false},
+	}
+	for _, tt := range tests {
+		got, err := resolveConflict(context.Background(), tt.policy, localPath, tt.path, stat)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("resolveConflict(%s, %s) error = %v", tt.policy, tt.path, err)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("resolveConflict(%s, %s) = %+v, want %+v", tt.policy, tt.path, got, tt.want)
+		}
+	}
+	if got := renamed("dir.v2/name.tar.gz", 1); got != "dir.v2/name.tar_1.gz" {
+		t.Errorf("renamed() = %s", got)
+	}
+	if got := renamed("dir.v2/name", 3); got != "dir.v2/name_3" {
+		t.Errorf("renamed() = %s", got)
+	}
+}
@@ -0,0 +1,151 @@
+package uploaders
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pluveto/upgit/lib/model"
+	"github.com/pluveto/upgit/lib/xapp"
+	"github.com/pluveto/upgit/lib/xlog"
+	"github.com/pluveto/upgit/lib/xprogress"
+	"github.com/pluveto/upgit/lib/xretry"
+)
+
+// contentsAPI is a forge API committing one file per request, like the
+// Contents API of GitHub
+type contentsAPI interface {
+	// stat returns git blob sha of the file at path on the branch, or "" if
+	// there is none
+	stat(ctx context.Context, path string) (string, error)
+	// put commits file at localPath to path and returns sha of the commit if
+	// the API tells it. sha is the one of the file to replace, or empty to
+	// create a new file.
+	put(ctx context.Context, message, localPath, path, sha string) (commit string, err error)
+	// lastCommit returns sha of a commit of the branch holding the file at
+	// path as it is now
+	lastCommit(ctx context.Context, path string) (string, error)
+	// rawUrl returns raw url of the file at path in commit
+	rawUrl(path, commit string) string
+}
+
+// forgeOptions are settings shared by uploaders built on a contentsAPI
+type forgeOptions struct {
+	// OnConflict is the policy for an existing path, DefaultConflictPolicy if not set
+	OnConflict    string
+	CommitMessage string
+	// Pinned tells whether urls contain the commit of the upload
+	Pinned bool
+}
+
+// uploadContents uploads task t through api the way GithubUploader does in
+// contents mode
+func uploadContents(ctx context.Context, api contentsAPI, fo forgeOptions, opts xapp.UploaderOptions, t *model.Task) error {
+	now := time.Now()
+	base := filepath.Base(t.LocalPath)
+	var targetPath string
+	if len(t.TargetDir) > 0 {
+		targetPath = t.TargetDir + "/" + base
+	} else {
+		targetPath = xapp.Rename(base, now)
+	}
+	xlog.GVerbose.Info("uploading #TASK_%d %s\n", t.TaskId, t.LocalPath)
+	policy := fo.OnConflict
+	if policy == "" {
+		policy = DefaultConflictPolicy
+	}
+	// each attempt resolves targetPath again, as paths may be taken meanwhile
+	resolved := targetPath
+	var commit string
+	attempts, err := xretry.Do(ctx, opts.Retry, func() (err error) {
+		c, err := resolveConflict(ctx, policy, t.LocalPath, targetPath, api.stat)
+		if err != nil {
+			return err
+		}
+		resolved = c.Path
+		commit = ""
+		if c.Identical {
+			xlog.GVerbose.Info("skipped #TASK_%d %s: identical to %s", t.TaskId, t.LocalPath, c.Path)
+		} else if commit, err = api.put(ctx, commitMessage(fo.CommitMessage, []string{base}), t.LocalPath, resolved, c.Sha); err != nil {
+			return err
+		}
+		if fo.Pinned && commit == "" {
+			commit, err = api.lastCommit(ctx, resolved)
+		}
+		return err
+	})
+	t.Attempts = attempts
+	t.TargetPath = resolved
+	t.FinishTime = time.Now()
+	if err != nil {
+		xlog.GVerbose.Info("failed to upload #TASK_%d %s : %s\n", t.TaskId, t.LocalPath, err.Error())
+		t.Status = model.TASK_FAILED
+		return err
+	}
+	t.RawUrl = api.rawUrl(resolved, commit)
+	t.Url = xapp.ReplaceUrl(t.RawUrl)
+	xlog.GVerbose.Info("sucessfully uploaded #TASK_%d %s => %s\n", t.TaskId, t.LocalPath, t.Url)
+	t.Status = model.TASK_FINISHED
+	return nil
+}
+
+// forgeClient sends api requests authorized by header
+type forgeClient struct {
+	Options xapp.UploaderOptions
+	// header is set on every request, carrying the token
+	header http.Header
+}
+
+// do sends an api request and decodes json response into out if it isn't nil
+func (c forgeClient) do(ctx context.Context, method, url string, body io.Reader, length int64, out interface{}) error {
+	xlog.GVerbose.Trace(method + " " + url)
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.ContentLength = length
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range c.header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Accept", "application/json")
+	return sendRequest(c.Options.HTTPClient(), req, out)
+}
+
+// doJSON sends in as json body of an api request
+func (c forgeClient) doJSON(ctx context.Context, method, url string, in, out interface{}) error {
+	buf, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, method, url, bytes.NewReader(buf), int64(len(buf)), out)
+}
+
+// putFile sends a json body made of fields and base64 content of file at
+// localPath under key "content", showing progress
+func (c forgeClient) putFile(ctx context.Context, method, url string, fields map[string]string, localPath string, out interface{}) (err error) {
+	head, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	body, length, err := base64JSONBody(strings.TrimSuffix(string(head), "}")+`,"content":"`, localPath, `"}`)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	tracker := xprogress.Start(ctx, length)
+	defer func() { tracker.Finish(err) }()
+	return c.do(ctx, method, url, tracker.ReadCloser(body), length, out)
+}
+
+// forgeUrl fills urlfmt with vars, given as pairs of placeholder and value
+func forgeUrl(urlfmt string, vars ...string) string {
+	return strings.NewReplacer(vars...).Replace(urlfmt)
+}
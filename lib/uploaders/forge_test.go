@@ -0,0 +1,195 @@
+package uploaders
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pluveto/upgit/lib/model"
+	"github.com/pluveto/upgit/lib/xapp"
+	"github.com/pluveto/upgit/lib/xretry"
+)
+
+// fakeForge serves the contents APIs of Gitea and GitLab from memory
+type fakeForge struct {
+	t     *testing.T
+	mu    sync.Mutex
+	files map[string]string
+	// methods are the write requests received, like "POST a.txt"
+	methods []string
+	commits int
+}
+
+func (f *fakeForge) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.URL.EscapedPath() {
+	case "/api/v1/repos/me/assets", "/api/v4/projects/group%2Fassets":
+		fmt.Fprint(w, `{"path_with_namespace":"group/assets","default_branch":"main"}`)
+		return
+	}
+	path, gitea := strings.CutPrefix(r.URL.Path, "/api/v1/repos/me/assets/contents/")
+	if gitea {
+		if r.Header.Get("Authorization") != "token secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	} else if r.URL.Path == "/api/v1/repos/me/assets/branches/main" {
+		fmt.Fprintf(w, `{"commit":{"id":"c%d"}}`, f.commits)
+		return
+	} else {
+		// project and file path are single encoded segments
+		const prefix = "/api/v4/projects/group%2Fassets/repository/files/"
+		if !strings.HasPrefix(r.URL.EscapedPath(), prefix) || r.Header.Get("Private-Token") != "secret" {
+			http.NotFound(w, r)
+			return
+		}
+		path = strings.TrimPrefix(r.URL.Path, "/api/v4/projects/group/assets/repository/files/")
+	}
+	// each forge has its own repository
+	key := r.URL.Path[:8] + path
+	content, exists := f.files[key]
+	if r.Method == http.MethodGet {
+		if ref := r.URL.Query().Get("ref"); ref != "main" {
+			f.t.Errorf("ref %q, want main", ref)
+		}
+		if !exists {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"type": "file", "sha": contentSha(f.t, content),
+			"blob_id": contentSha(f.t, content), "last_commit_id": fmt.Sprintf("c%d", f.commits),
+		})
+		return
+	}
+	var body map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		f.t.Error(err)
+	}
+	if body["branch"] != "main" {
+		f.t.Errorf("branch %q, want main", body["branch"])
+	}
+	// Gitea needs sha to replace a file, GitLab takes PUT alone
+	if exists != (r.Method == http.MethodPut) || gitea && exists && body["sha"] != contentSha(f.t, content) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	buf, err := base64.StdEncoding.DecodeString(body["content"])
+	if err != nil {
+		f.t.Error(err)
+	}
+	f.files[key] = string(buf)
+	f.commits++
+	f.methods = append(f.methods, r.Method+" "+path)
+	fmt.Fprintf(w, `{"commit":{"sha":"c%d"}}`, f.commits)
+}
+
+func TestForgeUploaders(t *testing.T) {
+	forge := &fakeForge{t: t, files: make(map[string]string)}
+	server := httptest.NewServer(forge)
+	defer server.Close()
+	src := t.TempDir()
+	write := func(content string) string {
+		p := filepath.Join(src, "a b.txt")
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	upload := func(u model.Uploader, p string) *model.Task {
+		task := &model.Task{LocalPath: p, TargetDir: "img"}
+		if err := u.Upload(task); err != nil {
+			t.Fatal(err)
+		}
+		return task
+	}
+
+	gitea := NewGiteaUploader(GiteaConfig{
+		BaseUrl: server.URL, Token: "secret", Owner: "me", Repo: "assets",
+		OnConflict: ConflictRename,
+	}, xapp.UploaderOptions{})
+	upload(gitea, write("one"))
+	task := upload(gitea, write("two"))
+	if want := server.URL + "/me/assets/raw/branch/main/img/a%20b_1.txt"; task.RawUrl != want {
+		t.Errorf("gitea url %s, want %s", task.RawUrl, want)
+	}
+	gitea.Config.PinCommit = true
+	task = upload(gitea, write("two"))
+	if want := server.URL + "/me/assets/raw/commit/c2/img/a%20b_1.txt"; task.RawUrl != want {
+		t.Errorf("gitea pinned url of identical file %s, want %s", task.RawUrl, want)
+	}
+
+	gitlab := NewGitlabUploader(GitlabConfig{
+		BaseUrl: server.URL, Token: "secret", Project: "group/assets", Branch: "main",
+		OnConflict: ConflictOverwrite, PinCommit: true,
+	}, xapp.UploaderOptions{})
+	upload(gitlab, write("one"))
+	task = upload(gitlab, write("three"))
+	if want := server.URL + "/group/assets/-/raw/c4/img/a%20b.txt"; task.RawUrl != want {
+		t.Errorf("gitlab url %s, want %s", task.RawUrl, want)
+	}
+
+	want := []string{"POST img/a b.txt", "POST img/a b_1.txt", "POST img/a b.txt", "PUT img/a b.txt"}
+	if strings.Join(forge.methods, ",") != strings.Join(want, ",") {
+		t.Errorf("requests %v, want %v", forge.methods, want)
+	}
+}
+
+// racingContents is a contentsAPI whose first put fails after another
+// upload takes the path
+type racingContents struct {
+	t     *testing.T
+	files map[string]string
+	puts  int
+}
+
+func (r *racingContents) stat(ctx context.Context, path string) (string, error) {
+	if content, ok := r.files[path]; ok {
+		return contentSha(r.t, content), nil
+	}
+	return "", nil
+}
+
+func (r *racingContents) put(ctx context.Context, message, localPath, path, sha string) (string, error) {
+	r.puts++
+	if r.puts == 1 {
+		r.files[path] = "other"
+		return "", xretry.Retryable(errors.New("conflict"), 0)
+	}
+	r.files[path] = "mine"
+	return "c1", nil
+}
+
+func (r *racingContents) lastCommit(ctx context.Context, path string) (string, error) {
+	return "c1", nil
+}
+
+func (r *racingContents) rawUrl(path, commit string) string {
+	return path
+}
+
+func TestUploadContentsRenamesFromTarget(t *testing.T) {
+	api := &racingContents{t: t, files: map[string]string{"img/a.png": "taken"}}
+	local := filepath.Join(t.TempDir(), "a.png")
+	if err := os.WriteFile(local, []byte("mine"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	task := &model.Task{LocalPath: local, TargetDir: "img"}
+	opts := xapp.UploaderOptions{Retry: xretry.Policy{BaseDelayMs: 1, MaxDelayMs: 1}}
+	if err := uploadContents(context.Background(), api, forgeOptions{OnConflict: ConflictRename}, opts, task); err != nil {
+		t.Fatal(err)
+	}
+	if task.TargetPath != "img/a_2.png" || api.files["img/a_2.png"] != "mine" {
+		t.Errorf("uploaded to %s, want img/a_2.png", task.TargetPath)
+	}
+}
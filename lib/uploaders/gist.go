@@ -0,0 +1,194 @@
+package uploaders
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pluveto/upgit/lib/model"
+	"github.com/pluveto/upgit/lib/xapp"
+	"github.com/pluveto/upgit/lib/xlog"
+	"github.com/pluveto/upgit/lib/xretry"
+)
+
+// DefaultGistDescription is the description of created gists
+const DefaultGistDescription = "uploaded via upgit client"
+
+// GistConfig is the [uploaders.gist] config. pat and api_base not set here
+// are taken from [uploaders.github].
+type GistConfig struct {
+	PAT     string `toml:"pat,omitempty" mapstructure:"pat" validate:"nonzero"`
+	ApiBase string `toml:"api_base,omitempty" mapstructure:"api_base"`
+	// GistId appends files to an existing gist instead of creating one
+	GistId string `toml:"gist_id,omitempty" mapstructure:"gist_id"`
+	// Public creates a public gist, otherwise a secret one
+	Public      bool   `toml:"public,omitempty" mapstructure:"public"`
+	Description string `toml:"description,omitempty" mapstructure:"description"`
+}
+
+// Inherit fills credentials not set from config of github uploader
+func (c *GistConfig) Inherit(g GithubUploaderConfig) {
+	if c.PAT == "" {
+		c.PAT = g.PAT
+	}
+	if c.ApiBase == "" {
+		c.ApiBase = g.ApiBase
+	}
+}
+
+// GistUploader puts all files of a run into one gist. It is a
+// model.BatchUploader: files are read by Upload and sent by Flush. Url of a
+// task is the gist page, RawUrl is the raw url of its file.
+type GistUploader struct {
+	Config  GistConfig
+	Options xapp.UploaderOptions
+
+	// api sends requests with credentials of Config
+	api *GithubUploader
+
+	mu     sync.Mutex
+	staged []gistFile
+}
+
+type gistFile struct {
+	Name    string
+	Content string
+	Task    *model.Task
+}
+
+// gist is the part of a gist used by upgit
+type gist struct {
+	ID      string `json:"id"`
+	HTMLURL string `json:"html_url"`
+	Files   map[string]struct {
+		RawURL string `json:"raw_url"`
+	} `json:"files"`
+}
+
+func NewGistUploader(cfg GistConfig, opts xapp.UploaderOptions) *GistUploader {
+	return &GistUploader{
+		Config:  cfg,
+		Options: opts,
+		api: &GithubUploader{
+			Config:  GithubUploaderConfig{PAT: cfg.PAT, ApiBase: cfg.ApiBase},
+			Options: opts,
+		},
+	}
+}
+
+func (u *GistUploader) Upload(t *model.Task) error {
+	return u.UploadContext(context.Background(), t)
+}
+
+func (u *GistUploader) UploadContext(ctx context.Context, t *model.Task) error {
+	xlog.GVerbose.Info("staging #TASK_%d %s\n", t.TaskId, t.LocalPath)
+	buf, err := ioutil.ReadFile(t.LocalPath)
+	if err == nil && !utf8.Valid(buf) {
+		err = errors.New("gist only takes text files")
+	}
+	t.Attempts = 1
+	t.FinishTime = time.Now()
+	if err != nil {
+		xlog.GVerbose.Info("failed to upload #TASK_%d %s : %s\n", t.TaskId, t.LocalPath, err.Error())
+		t.Status = model.TASK_FAILED
+		return err
+	}
+	u.mu.Lock()
+	u.staged = append(u.staged, gistFile{Name: filepath.Base(t.LocalPath), Content: string(buf), Task: t})
+	u.mu.Unlock()
+	t.Status = model.TASK_FINISHED
+	return nil
+}
+
+// Flush creates the gist, or adds files to Config.GistId, and sets urls of
+// staged tasks
+func (u *GistUploader) Flush(ctx context.Context) ([]*model.Task, error) {
+	u.mu.Lock()
+	staged := u.staged
+	u.staged = nil
+	u.mu.Unlock()
+	if len(staged) == 0 {
+		return nil, nil
+	}
+	tasks := make([]*model.Task, len(staged))
+	for i, f := range staged {
+		tasks[i] = f.Task
+	}
+	var ret gist
+	// names of staged files in the gist, renamed to not replace others
+	names := make([]string, len(staged))
+	_, err := xretry.Do(ctx, u.Options.Retry, func() error {
+		taken := make(map[string]bool)
+		if u.Config.GistId != "" {
+			var existing gist
+			if err := u.api.do(ctx, http.MethodGet, u.url(), nil, 0, &existing); err != nil {
+				return err
+			}
+			for name := range existing.Files {
+				taken[name] = true
+			}
+		}
+		files := make(map[string]interface{})
+		for i, f := range staged {
+			name, err := freeName(f.Name, taken)
+			if err != nil {
+				return err
+			}
+			taken[name] = true
+			names[i] = name
+			files[name] = map[string]string{"content": f.Content}
+		}
+		if u.Config.GistId != "" {
+			return u.api.doJSON(ctx, http.MethodPatch, u.url(), map[string]interface{}{
+				"files": files,
+			}, &ret)
+		}
+		description := u.Config.Description
+		if description == "" {
+			description = DefaultGistDescription
+		}
+		return u.api.doJSON(ctx, http.MethodPost, u.url(), map[string]interface{}{
+			"description": description,
+			"public":      u.Config.Public,
+			"files":       files,
+		}, &ret)
+	})
+	if err != nil {
+		return tasks, err
+	}
+	xlog.GVerbose.Info("uploaded %d files to gist %s", len(staged), ret.HTMLURL)
+	for i, f := range staged {
+		f.Task.Url = xapp.ReplaceUrl(ret.HTMLURL)
+		f.Task.RawUrl = xapp.ReplaceUrl(ret.Files[names[i]].RawURL)
+		f.Task.TargetPath = names[i]
+	}
+	return tasks, nil
+}
+
+// url returns api url of the gist, or of gists if none is set
+func (u *GistUploader) url() string {
+	url := u.api.Config.apiBase() + "/gists"
+	if u.Config.GistId != "" {
+		url += "/" + u.Config.GistId
+	}
+	return url
+}
+
+// freeName returns name, or the first of name_1, name_2 ... not taken
+func freeName(name string, taken map[string]bool) (string, error) {
+	if !taken[name] {
+		return name, nil
+	}
+	for i := 1; i <= maxRenames; i++ {
+		if candidate := renamed(name, i); !taken[candidate] {
+			return candidate, nil
+		}
+	}
+	return "", xretry.Fatal(fmt.Errorf("no free name for %s after %d tries", name, maxRenames))
+}
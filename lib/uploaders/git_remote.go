@@ -0,0 +1,170 @@
+package uploaders
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/capability"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/sideband"
+	"github.com/go-git/go-git/v5/plumbing/revlist"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/storage"
+
+	"github.com/pluveto/upgit/lib/xapp"
+	"github.com/pluveto/upgit/lib/xretry"
+)
+
+// gitRemote fetches and pushes a branch through a transport of its own.
+// go-git's Fetch and Push take the transport registered for the protocol,
+// which is shared by the whole process.
+type gitRemote struct {
+	endpoint  *transport.Endpoint
+	transport transport.Transport
+	auth      transport.AuthMethod
+}
+
+// newGitRemote connects to url with the http client of opts for http and
+// https, or the transport go-git has for other protocols
+func newGitRemote(url string, opts xapp.UploaderOptions, auth transport.AuthMethod) (*gitRemote, error) {
+	ep, err := transport.NewEndpoint(url)
+	if err != nil {
+		return nil, err
+	}
+	var t transport.Transport
+	switch ep.Protocol {
+	case "http", "https":
+		t = githttp.NewClient(opts.HTTPClient())
+	default:
+		if t, err = client.NewClient(ep); err != nil {
+			return nil, err
+		}
+	}
+	return &gitRemote{endpoint: ep, transport: t, auth: auth}, nil
+}
+
+// fetch downloads the head of branch into s, sending haves as the commits
+// s already has. It returns the branch and its head, zero if the branch
+// doesn't exist. An empty branch is the one HEAD of the remote points to.
+func (r *gitRemote) fetch(ctx context.Context, s storage.Storer, branch string, haves []plumbing.Hash) (string, plumbing.Hash, error) {
+	sess, err := r.transport.NewUploadPackSession(r.endpoint, r.auth)
+	if err != nil {
+		return "", plumbing.ZeroHash, err
+	}
+	defer sess.Close()
+	ar, err := sess.AdvertisedReferencesContext(ctx)
+	if errors.Is(err, transport.ErrEmptyRemoteRepository) {
+		if branch == "" {
+			return "", plumbing.ZeroHash, r.errNoHead()
+		}
+		return branch, plumbing.ZeroHash, nil
+	}
+	if err != nil {
+		return "", plumbing.ZeroHash, err
+	}
+	refs, err := ar.AllReferences()
+	if err != nil {
+		return "", plumbing.ZeroHash, err
+	}
+	if branch == "" {
+		head, err := refs.Reference(plumbing.HEAD)
+		if err != nil || head.Type() != plumbing.SymbolicReference || !head.Target().IsBranch() {
+			return "", plumbing.ZeroHash, r.errNoHead()
+		}
+		branch = head.Target().Short()
+	}
+	ref, err := refs.Reference(plumbing.NewBranchReferenceName(branch))
+	if errors.Is(err, plumbing.ErrReferenceNotFound) {
+		// the branch is created by the first push
+		return branch, plumbing.ZeroHash, nil
+	}
+	if err != nil {
+		return "", plumbing.ZeroHash, err
+	}
+	if _, err := s.EncodedObject(plumbing.CommitObject, ref.Hash()); err == nil {
+		return branch, ref.Hash(), nil
+	}
+
+	req := packp.NewUploadPackRequestFromCapabilities(ar.Capabilities)
+	req.Wants = []plumbing.Hash{ref.Hash()}
+	req.Haves = haves
+	reader, err := sess.UploadPack(ctx, req)
+	if err != nil {
+		return "", plumbing.ZeroHash, err
+	}
+	defer reader.Close()
+	var pack io.Reader = reader
+	switch {
+	case req.Capabilities.Supports(capability.Sideband64k):
+		pack = sideband.NewDemuxer(sideband.Sideband64k, reader)
+	case req.Capabilities.Supports(capability.Sideband):
+		pack = sideband.NewDemuxer(sideband.Sideband, reader)
+	}
+	if err := packfile.UpdateObjectStorage(s, pack); err != nil {
+		return "", plumbing.ZeroHash, err
+	}
+	return branch, ref.Hash(), nil
+}
+
+func (r *gitRemote) errNoHead() error {
+	return xretry.Fatal(fmt.Errorf("%s doesn't tell its default branch, set branch", r.endpoint.String()))
+}
+
+// push moves branch from old, zero to create it, to commit, sending the
+// objects of commit old doesn't have. It fails with
+// git.ErrNonFastForwardUpdate if the remote branch is no longer at old.
+func (r *gitRemote) push(ctx context.Context, s storage.Storer, branch string, old, commit plumbing.Hash) error {
+	sess, err := r.transport.NewReceivePackSession(r.endpoint, r.auth)
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+	ar, err := sess.AdvertisedReferencesContext(ctx)
+	if err != nil {
+		return err
+	}
+	name := plumbing.NewBranchReferenceName(branch)
+	if ar.References[name.String()] != old {
+		return fmt.Errorf("%w: %s", git.ErrNonFastForwardUpdate, name)
+	}
+	var ignore []plumbing.Hash
+	if !old.IsZero() {
+		ignore = append(ignore, old)
+	}
+	hashes, err := revlist.Objects(s, []plumbing.Hash{commit}, ignore)
+	if err != nil {
+		return err
+	}
+
+	req := packp.NewReferenceUpdateRequestFromCapabilities(ar.Capabilities)
+	req.Commands = []*packp.Command{{Name: name, Old: old, New: commit}}
+	rd, wr := io.Pipe()
+	req.Packfile = rd
+	// buffered, so that encoding ends even if ReceivePack fails
+	done := make(chan error, 1)
+	go func() {
+		e := packfile.NewEncoder(wr, s, !ar.Capabilities.Supports(capability.OFSDelta))
+		_, err := e.Encode(hashes, 10)
+		wr.CloseWithError(err)
+		done <- err
+	}()
+	report, err := sess.ReceivePack(ctx, req)
+	if err != nil {
+		rd.Close()
+		return err
+	}
+	if err := <-done; err != nil {
+		return err
+	}
+	if report != nil {
+		return report.Error()
+	}
+	return nil
+}
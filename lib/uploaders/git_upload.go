@@ -0,0 +1,530 @@
+package uploaders
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/index"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+
+	"github.com/pluveto/upgit/lib/model"
+	"github.com/pluveto/upgit/lib/xapp"
+	"github.com/pluveto/upgit/lib/xgit"
+	"github.com/pluveto/upgit/lib/xhttp"
+	"github.com/pluveto/upgit/lib/xio"
+	"github.com/pluveto/upgit/lib/xlog"
+	"github.com/pluveto/upgit/lib/xpath"
+	"github.com/pluveto/upgit/lib/xretry"
+)
+
+// GitConfig is the [uploaders.git] config
+type GitConfig struct {
+	// Remote is the url of the repository, like
+	// git@git.example.com:team/assets.git, https://git.example.com/team/assets.git
+	// or a local path
+	Remote string `toml:"remote" mapstructure:"remote" validate:"nonzero"`
+	// Branch is the one HEAD of the remote points to if not set
+	Branch string `toml:"branch,omitempty" mapstructure:"branch"`
+	// UrlFormat is the format of file urls, in which {branch}, {commit} and
+	// {path} are replaced
+	UrlFormat string `toml:"url_format" mapstructure:"url_format" validate:"nonzero"`
+	// CacheDir is the local clone, a dir under <app dir>/cache/git if not set
+	CacheDir string `toml:"cache_dir,omitempty" mapstructure:"cache_dir"`
+
+	// Username and Password are for https remotes. Password may be a token.
+	Username string `toml:"username,omitempty" mapstructure:"username"`
+	Password string `toml:"password,omitempty" mapstructure:"password"`
+	// SSHKey is the private key file for ssh remotes. ssh-agent is used if
+	// not set.
+	SSHKey           string `toml:"ssh_key,omitempty" mapstructure:"ssh_key"`
+	SSHKeyPassphrase string `toml:"ssh_key_passphrase,omitempty" mapstructure:"ssh_key_passphrase"`
+	// KnownHosts is the known_hosts file checking ssh host keys,
+	// ~/.ssh/known_hosts if not set
+	KnownHosts string `toml:"known_hosts,omitempty" mapstructure:"known_hosts"`
+
+	AuthorName    string `toml:"author_name,omitempty" mapstructure:"author_name"`
+	AuthorEmail   string `toml:"author_email,omitempty" mapstructure:"author_email"`
+	CommitMessage string `toml:"commit_message,omitempty" mapstructure:"commit_message"`
+	// OnConflict is the policy for an existing path, DefaultConflictPolicy if not set
+	OnConflict string `toml:"on_conflict,omitempty" mapstructure:"on_conflict"`
+}
+
+// Validate checks fields not covered by validator tags
+func (c GitConfig) Validate() error {
+	if err := validConflictPolicy(c.OnConflict); err != nil {
+		return errors.New("git: " + err.Error())
+	}
+	return nil
+}
+
+// GitUploader commits files to a local clone of a repository and pushes
+// them. It is a model.BatchUploader: files of a run are pushed in one
+// commit by Flush.
+type GitUploader struct {
+	Config  GitConfig
+	Options xapp.UploaderOptions
+
+	mu sync.Mutex
+	// lock keeps other processes out of the cache clone from prepare until
+	// Flush
+	lock   *os.File
+	repo   *git.Repository
+	remote *gitRemote
+	// defaultBranch is the branch HEAD of the remote points to, fetched if
+	// Branch is not set
+	defaultBranch string
+	// head is the branch head fetched before the first upload, zero if the
+	// branch doesn't exist yet
+	head   plumbing.Hash
+	staged []gitFile
+	// beforePush is called by tests between committing and pushing
+	beforePush func()
+}
+
+type gitFile struct {
+	// LocalPath is empty for a file identical to the one at Path
+	LocalPath string
+	Path      string
+	Task      *model.Task
+}
+
+const kRemoteName = "origin"
+
+func (u *GitUploader) Upload(t *model.Task) error {
+	return u.UploadContext(context.Background(), t)
+}
+
+func (u *GitUploader) UploadContext(ctx context.Context, t *model.Task) error {
+	base := filepath.Base(t.LocalPath)
+	var targetPath string
+	if len(t.TargetDir) > 0 {
+		targetPath = t.TargetDir + "/" + base
+	} else {
+		targetPath = xapp.Rename(base, time.Now())
+	}
+	policy := u.Config.OnConflict
+	if policy == "" {
+		policy = DefaultConflictPolicy
+	}
+	xlog.GVerbose.Info("staging #TASK_%d %s\n", t.TaskId, t.LocalPath)
+	attempts, err := xretry.Do(ctx, u.Options.Retry, func() error {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		if err := u.prepare(ctx); err != nil {
+			return err
+		}
+		c, err := resolveConflict(ctx, policy, t.LocalPath, targetPath, u.stat)
+		if err != nil {
+			return err
+		}
+		f := gitFile{LocalPath: t.LocalPath, Path: c.Path, Task: t}
+		if c.Identical {
+			xlog.GVerbose.Info("skipped #TASK_%d %s: identical to %s", t.TaskId, t.LocalPath, c.Path)
+			if !u.isStaged(c.Path) {
+				// the file is in the fetched head, so the task is done
+				u.setUrls(t, c.Path, u.head)
+				return nil
+			}
+			f.LocalPath = ""
+		}
+		u.staged = append(u.staged, f)
+		return nil
+	})
+	t.Attempts = attempts
+	t.FinishTime = time.Now()
+	if err != nil {
+		xlog.GVerbose.Info("failed to upload #TASK_%d %s : %s\n", t.TaskId, t.LocalPath, err.Error())
+		t.Status = model.TASK_FAILED
+		return err
+	}
+	t.Status = model.TASK_FINISHED
+	return nil
+}
+
+// Flush commits staged files on top of the remote branch and pushes them.
+// When others push in the meantime, the commit is made again on top of the
+// new head.
+func (u *GitUploader) Flush(ctx context.Context) ([]*model.Task, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	defer u.release()
+	staged := u.staged
+	u.staged = nil
+	if len(staged) == 0 {
+		return nil, nil
+	}
+	tasks := make([]*model.Task, len(staged))
+	var names []string
+	for i, f := range staged {
+		tasks[i] = f.Task
+		if f.LocalPath != "" {
+			names = append(names, filepath.Base(f.Path))
+		}
+	}
+	message := commitMessage(u.Config.CommitMessage, names)
+
+	var commit plumbing.Hash
+	var err error
+	for i := 0; i < maxRefUpdates; i++ {
+		_, err = xretry.Do(ctx, u.Options.Retry, func() (err error) {
+			commit, err = u.publish(ctx, message, staged)
+			return err
+		})
+		if err == nil || !isNonFastForward(err) {
+			break
+		}
+		xlog.GVerbose.Info("branch %s moved while pushing, rebasing", u.branch())
+	}
+	if err != nil {
+		return tasks, err
+	}
+	u.head = commit
+	for _, f := range staged {
+		u.setUrls(f.Task, f.Path, commit)
+	}
+	return tasks, nil
+}
+
+// isStaged tells whether a file is staged at path in this run
+func (u *GitUploader) isStaged(path string) bool {
+	for _, f := range u.staged {
+		if f.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// setUrls sets target path and urls of task t committed to path in commit
+func (u *GitUploader) setUrls(t *model.Task, path string, commit plumbing.Hash) {
+	t.TargetPath = path
+	t.RawUrl = u.buildUrl(path, commit.String())
+	t.Url = xapp.ReplaceUrl(t.RawUrl)
+}
+
+func (u *GitUploader) branch() string {
+	if u.Config.Branch == "" {
+		return u.defaultBranch
+	}
+	return u.Config.Branch
+}
+
+func (u *GitUploader) buildUrl(path, commit string) string {
+	return strings.NewReplacer(
+		"{branch}", u.branch(),
+		"{commit}", commit,
+		"{path}", xhttp.EscapePath(path),
+	).Replace(u.Config.UrlFormat)
+}
+
+func (u *GitUploader) cacheDir() string {
+	if u.Config.CacheDir != "" {
+		return u.Config.CacheDir
+	}
+	sum := sha1.Sum([]byte(u.Config.Remote + "#" + u.Config.Branch))
+	return xpath.MustGetApplicationPath(fmt.Sprintf("cache/git/%x", sum[:6]))
+}
+
+func (u *GitUploader) auth() (transport.AuthMethod, error) {
+	ep, err := transport.NewEndpoint(u.Config.Remote)
+	if err != nil {
+		return nil, xretry.Fatal(err)
+	}
+	switch ep.Protocol {
+	case "http", "https":
+		if u.Config.Username == "" && u.Config.Password == "" {
+			return nil, nil
+		}
+		return &githttp.BasicAuth{Username: u.Config.Username, Password: u.Config.Password}, nil
+	case "ssh":
+		if u.Config.SSHKey == "" && u.Config.KnownHosts == "" {
+			// go-git uses ssh-agent and ~/.ssh/known_hosts
+			return nil, nil
+		}
+		user := ep.User
+		if user == "" {
+			user = "git"
+		}
+		var helper *gitssh.HostKeyCallbackHelper
+		var auth transport.AuthMethod
+		if u.Config.SSHKey != "" {
+			keys, err := gitssh.NewPublicKeysFromFile(user, u.Config.SSHKey, u.Config.SSHKeyPassphrase)
+			if err != nil {
+				return nil, xretry.Fatal(err)
+			}
+			helper, auth = &keys.HostKeyCallbackHelper, keys
+		} else {
+			agent, err := gitssh.NewSSHAgentAuth(user)
+			if err != nil {
+				return nil, xretry.Fatal(err)
+			}
+			helper, auth = &agent.HostKeyCallbackHelper, agent
+		}
+		if u.Config.KnownHosts != "" {
+			helper.HostKeyCallback, err = gitssh.NewKnownHostsCallback(u.Config.KnownHosts)
+			if err != nil {
+				return nil, xretry.Fatal(err)
+			}
+		}
+		return auth, nil
+	}
+	return nil, nil
+}
+
+// prepare locks and opens the cache clone, creating it on first use, and
+// fetches the branch. It does the work once, before the first upload of a
+// batch.
+func (u *GitUploader) prepare(ctx context.Context) (err error) {
+	if u.repo != nil {
+		return nil
+	}
+	auth, err := u.auth()
+	if err != nil {
+		return err
+	}
+	// honor timeouts and ca_file of options
+	if u.remote, err = newGitRemote(u.Config.Remote, u.Options, auth); err != nil {
+		return xretry.Fatal(err)
+	}
+	dir := u.cacheDir()
+	if u.lock == nil {
+		xlog.GVerbose.Trace("locking %s", dir)
+		if u.lock, err = xio.LockFile(dir + ".lock"); err != nil {
+			return xretry.Fatal(err)
+		}
+	}
+	defer func() {
+		if err != nil {
+			u.release()
+		}
+	}()
+	repo, err := git.PlainOpen(dir)
+	if errors.Is(err, git.ErrRepositoryNotExists) {
+		xlog.GVerbose.Info("creating cache clone of %s in %s", u.Config.Remote, dir)
+		repo, err = git.PlainInit(dir, false)
+		if err == nil {
+			_, err = repo.CreateRemote(&config.RemoteConfig{Name: kRemoteName, URLs: []string{u.Config.Remote}})
+		}
+	}
+	if err != nil {
+		return xretry.Fatal(err)
+	}
+	head, err := u.fetch(ctx, repo)
+	if err != nil {
+		return err
+	}
+	u.repo = repo
+	u.head = head
+	return nil
+}
+
+// release unlocks the cache clone, which is opened and fetched again by the
+// next prepare
+func (u *GitUploader) release() {
+	if u.lock != nil {
+		u.lock.Close()
+		u.lock = nil
+	}
+	u.repo = nil
+}
+
+// fetch fetches the branch and returns its head, or zero hash if it doesn't
+// exist on remote. The head is kept as the remote branch of the clone, sent
+// as have by the next fetch.
+func (u *GitUploader) fetch(ctx context.Context, repo *git.Repository) (plumbing.Hash, error) {
+	xlog.GVerbose.Trace("fetching %s of %s", u.branch(), u.Config.Remote)
+	var haves []plumbing.Hash
+	if u.branch() != "" {
+		if ref, err := repo.Reference(plumbing.NewRemoteReferenceName(kRemoteName, u.branch()), true); err == nil {
+			haves = append(haves, ref.Hash())
+		}
+	}
+	branch, head, err := u.remote.fetch(ctx, repo.Storer, u.Config.Branch, haves)
+	switch {
+	case err == nil:
+	case errors.Is(err, transport.ErrAuthenticationRequired), errors.Is(err, transport.ErrAuthorizationFailed),
+		errors.Is(err, transport.ErrRepositoryNotFound), errors.Is(err, transport.ErrInvalidAuthMethod):
+		return plumbing.ZeroHash, xretry.Fatal(err)
+	default:
+		return plumbing.ZeroHash, err
+	}
+	if u.Config.Branch == "" {
+		u.defaultBranch = branch
+	}
+	remoteRef := plumbing.NewRemoteReferenceName(kRemoteName, branch)
+	if head.IsZero() {
+		return head, repo.Storer.RemoveReference(remoteRef)
+	}
+	return head, repo.Storer.SetReference(plumbing.NewHashReference(remoteRef, head))
+}
+
+// stat returns git blob sha of the file at path on the branch, including
+// files staged in this run, or "" if there is none
+func (u *GitUploader) stat(ctx context.Context, path string) (string, error) {
+	for i := len(u.staged) - 1; i >= 0; i-- {
+		if f := u.staged[i]; f.Path == path && f.LocalPath != "" {
+			return xgit.BlobSHA(f.LocalPath)
+		}
+	}
+	if u.head.IsZero() {
+		return "", nil
+	}
+	commit, err := u.repo.CommitObject(u.head)
+	if err != nil {
+		return "", err
+	}
+	file, err := commit.File(path)
+	if errors.Is(err, object.ErrFileNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return file.Hash.String(), nil
+}
+
+// publish fetches the branch, commits staged files on top of it and pushes
+// the commit. It returns the commit the files are in.
+func (u *GitUploader) publish(ctx context.Context, message string, staged []gitFile) (plumbing.Hash, error) {
+	head, err := u.fetch(ctx, u.repo)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	u.head = head
+	if err := u.checkout(head); err != nil {
+		return plumbing.ZeroHash, xretry.Fatal(err)
+	}
+	w, err := u.repo.Worktree()
+	if err != nil {
+		return plumbing.ZeroHash, xretry.Fatal(err)
+	}
+	for _, f := range staged {
+		if f.LocalPath == "" {
+			continue
+		}
+		if err := copyFile(f.LocalPath, filepath.Join(w.Filesystem.Root(), filepath.FromSlash(f.Path))); err != nil {
+			return plumbing.ZeroHash, xretry.Fatal(err)
+		}
+		if _, err := w.Add(f.Path); err != nil {
+			return plumbing.ZeroHash, xretry.Fatal(err)
+		}
+	}
+	name, email := u.Config.AuthorName, u.Config.AuthorEmail
+	if name == "" {
+		name = "upgit"
+	}
+	if email == "" {
+		email = "upgit@localhost"
+	}
+	commit, err := w.Commit(message, &git.CommitOptions{
+		Author: &object.Signature{Name: name, Email: email, When: time.Now()},
+	})
+	if errors.Is(err, git.ErrEmptyCommit) {
+		// every file is already there
+		return head, nil
+	}
+	if err != nil {
+		return plumbing.ZeroHash, xretry.Fatal(err)
+	}
+	if u.beforePush != nil {
+		u.beforePush()
+	}
+	xlog.GVerbose.Info("pushing commit %s to %s", commit, u.Config.Remote)
+	err = u.remote.push(ctx, u.repo.Storer, u.branch(), head, commit)
+	if err != nil && isNonFastForward(err) {
+		return plumbing.ZeroHash, xretry.Fatal(err)
+	}
+	return commit, err
+}
+
+// setBranch points the local branch to head, removing it if head is zero
+func (u *GitUploader) setBranch(head plumbing.Hash) error {
+	branch := plumbing.NewBranchReferenceName(u.branch())
+	if head.IsZero() {
+		return u.repo.Storer.RemoveReference(branch)
+	}
+	return u.repo.Storer.SetReference(plumbing.NewHashReference(branch, head))
+}
+
+// checkout moves the local branch and worktree to head. A zero head starts
+// an orphan branch with an empty worktree.
+func (u *GitUploader) checkout(head plumbing.Hash) error {
+	branch := plumbing.NewBranchReferenceName(u.branch())
+	if err := u.repo.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, branch)); err != nil {
+		return err
+	}
+	w, err := u.repo.Worktree()
+	if err != nil {
+		return err
+	}
+	if err := u.setBranch(head); err != nil {
+		return err
+	}
+	if !head.IsZero() {
+		return w.Reset(&git.ResetOptions{Commit: head, Mode: git.HardReset})
+	}
+	if err := u.repo.Storer.SetIndex(&index.Index{Version: 2}); err != nil {
+		return err
+	}
+	root := w.Filesystem.Root()
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Name() == git.GitDirName {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(root, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isNonFastForward tells whether a push was rejected because the remote
+// branch has commits not fetched
+func isNonFastForward(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, git.ErrNonFastForwardUpdate) {
+		return true
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "non-fast-forward") || strings.Contains(msg, "fetch first")
+}
+
+func copyFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,257 @@
+package uploaders
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	"github.com/go-git/go-git/v5/plumbing/transport/server"
+
+	"github.com/pluveto/upgit/lib/model"
+)
+
+// serveGitInProcess serves local remotes in process, instead of running
+// git-upload-pack and git-receive-pack binaries
+func serveGitInProcess() {
+	client.InstallProtocol("file", server.DefaultServer)
+}
+
+func TestGitUploader(t *testing.T) {
+	serveGitInProcess()
+	ctx := context.Background()
+	remote := t.TempDir()
+	if _, err := git.PlainInit(remote, true); err != nil {
+		t.Fatal(err)
+	}
+	src := t.TempDir()
+	write := func(name, content string) string {
+		p := filepath.Join(src, name)
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	newUploader := func() *GitUploader {
+		return &GitUploader{Config: GitConfig{
+			Remote:    remote,
+			Branch:    "master",
+			UrlFormat: "https://git.example.com/assets/raw/{commit}/{path}",
+			CacheDir:  t.TempDir(),
+		}}
+	}
+	upload := func(u *GitUploader, paths ...string) []*model.Task {
+		var tasks []*model.Task
+		for i, p := range paths {
+			task := &model.Task{TaskId: i, LocalPath: p, TargetDir: "img"}
+			if err := u.UploadContext(ctx, task); err != nil {
+				t.Fatal(err)
+			}
+			tasks = append(tasks, task)
+		}
+		if _, err := u.Flush(ctx); err != nil {
+			t.Fatal(err)
+		}
+		return tasks
+	}
+	head := func() string {
+		repo, err := git.PlainOpen(remote)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref, err := repo.Reference(plumbing.NewBranchReferenceName("master"), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ref.Hash().String()
+	}
+	files := func() []string {
+		repo, _ := git.PlainOpen(remote)
+		ref, _ := repo.Reference(plumbing.NewBranchReferenceName("master"), true)
+		commit, err := repo.CommitObject(ref.Hash())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		iter, _ := commit.Files()
+		iter.ForEach(func(f *object.File) error {
+			names = append(names, f.Name)
+			return nil
+		})
+		return names
+	}
+
+	// the first push creates the branch
+	a, b := write("a.png", "a"), write("b.png", "b")
+	tasks := upload(newUploader(), a, b)
+	first := head()
+	for _, task := range tasks {
+		want := "https://git.example.com/assets/raw/" + first + "/img/" + filepath.Base(task.LocalPath)
+		if task.RawUrl != want {
+			t.Errorf("url of %s = %s, want %s", task.LocalPath, task.RawUrl, want)
+		}
+	}
+
+	// an uploader fetching before another pushes still lands on top of it
+	late := newUploader()
+	c := write("c.png", "c")
+	task := &model.Task{LocalPath: c, TargetDir: "img"}
+	if err := late.UploadContext(ctx, task); err != nil {
+		t.Fatal(err)
+	}
+	upload(newUploader(), write("d.png", "d"))
+	if _, err := late.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(files(), ","); got != "img/a.png,img/b.png,img/c.png,img/d.png" {
+		t.Errorf("files = %s", got)
+	}
+
+	// a push between fetching and pushing is rejected as non-fast-forward,
+	// and the commit is made again on top of it
+	racing := newUploader()
+	pushes := 0
+	racing.beforePush = func() {
+		pushes++
+		if pushes == 1 {
+			upload(newUploader(), write("f.png", "f"))
+		}
+	}
+	upload(racing, write("g.png", "g"))
+	if pushes != 2 {
+		t.Errorf("pushed %d times, want 2", pushes)
+	}
+	if got := strings.Join(files(), ","); got != "img/a.png,img/b.png,img/c.png,img/d.png,img/f.png,img/g.png" {
+		t.Errorf("files = %s", got)
+	}
+
+	// an uploader of the same cache clone waits until the other one flushes
+	holder, waiter := newUploader(), newUploader()
+	waiter.Config.CacheDir = holder.Config.CacheDir
+	if err := holder.UploadContext(ctx, &model.Task{LocalPath: write("h.png", "h"), TargetDir: "img"}); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		done <- waiter.UploadContext(ctx, &model.Task{LocalPath: write("i.png", "i"), TargetDir: "img"})
+	}()
+	select {
+	case <-done:
+		t.Fatal("cache clone used by two uploaders at once")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if _, err := holder.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := waiter.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// identical files are not committed again
+	before := head()
+	tasks = upload(newUploader(), a)
+	if head() != before {
+		t.Errorf("identical file made a commit")
+	}
+	if !strings.Contains(tasks[0].RawUrl, before) {
+		t.Errorf("url of identical file = %s", tasks[0].RawUrl)
+	}
+
+	// a file identical to the head is done without staging, so that it
+	// doesn't fail with a failed push
+	u := newUploader()
+	same := &model.Task{LocalPath: a, TargetDir: "img"}
+	added := &model.Task{LocalPath: write("e.png", "e"), TargetDir: "img"}
+	for _, task := range []*model.Task{same, added} {
+		if err := u.UploadContext(ctx, task); err != nil {
+			t.Fatal(err)
+		}
+	}
+	staged, err := u.Flush(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(staged) != 1 || staged[0] != added {
+		t.Errorf("staged %v, want only %s", staged, added.LocalPath)
+	}
+}
+
+func TestGitUploaderDefaultBranch(t *testing.T) {
+	serveGitInProcess()
+	ctx := context.Background()
+	remote := t.TempDir()
+	repo, err := git.PlainInit(remote, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	main := plumbing.NewBranchReferenceName("main")
+	if err := repo.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, main)); err != nil {
+		t.Fatal(err)
+	}
+	newTask := func(name string) *model.Task {
+		p := filepath.Join(t.TempDir(), name)
+		if err := os.WriteFile(p, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return &model.Task{LocalPath: p, TargetDir: "img"}
+	}
+	upload := func(branch string, task *model.Task) error {
+		u := &GitUploader{Config: GitConfig{
+			Remote:    remote,
+			Branch:    branch,
+			UrlFormat: "https://git.example.com/assets/raw/{branch}/{path}",
+			CacheDir:  t.TempDir(),
+		}}
+		if err := u.UploadContext(ctx, task); err != nil {
+			return err
+		}
+		_, err := u.Flush(ctx)
+		return err
+	}
+
+	// the branch is created on an empty remote too
+	if err := upload("", newTask("a.png")); err != nil {
+		t.Fatal(err)
+	}
+	task := newTask("b.png")
+	if err := upload("", task); err != nil {
+		t.Fatal(err)
+	}
+	if want := "https://git.example.com/assets/raw/main/img/b.png"; task.RawUrl != want {
+		t.Errorf("url %s, want %s", task.RawUrl, want)
+	}
+	ref, err := repo.Reference(main, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := repo.CommitObject(ref.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := commit.File("img/b.png"); err != nil {
+		t.Errorf("img/b.png not on main: %v", err)
+	}
+	if _, err := commit.File("img/a.png"); err != nil {
+		t.Errorf("img/a.png not on main: %v", err)
+	}
+	if _, err := repo.Reference(plumbing.Master, false); err == nil {
+		t.Error("master created")
+	}
+
+	// without HEAD the branch must be set
+	if err := repo.Storer.RemoveReference(plumbing.HEAD); err != nil {
+		t.Fatal(err)
+	}
+	if err := upload("", newTask("c.png")); err == nil || !strings.Contains(err.Error(), "default branch") {
+		t.Errorf("upload to remote without HEAD: %v", err)
+	}
+}
@@ -0,0 +1,213 @@
+package uploaders
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"sync"
+
+	"github.com/pluveto/upgit/lib/model"
+	"github.com/pluveto/upgit/lib/xapp"
+	"github.com/pluveto/upgit/lib/xhttp"
+	"github.com/pluveto/upgit/lib/xretry"
+)
+
+// GiteaConfig is the [uploaders.gitea] config. It works as well with
+// Forgejo, Codeberg included.
+type GiteaConfig struct {
+	// BaseUrl is the root of the instance, like https://codeberg.org
+	BaseUrl string `toml:"base_url" mapstructure:"base_url" validate:"nonzero"`
+	Token   string `toml:"token" mapstructure:"token" validate:"nonzero"`
+	// Owner is the user or organization owning the repository
+	Owner string `toml:"owner" mapstructure:"owner" validate:"nonzero"`
+	Repo  string `toml:"repo" mapstructure:"repo" validate:"nonzero"`
+	// Branch is the default branch of the repository if not set
+	Branch string `toml:"branch,omitempty" mapstructure:"branch"`
+	// CommitMessage is a template like DefaultCommitMessage
+	CommitMessage string `toml:"commit_message,omitempty" mapstructure:"commit_message"`
+	// OnConflict is the policy for an existing path, DefaultConflictPolicy if not set
+	OnConflict string `toml:"on_conflict,omitempty" mapstructure:"on_conflict"`
+	// UrlFormat is the format of file urls, in which {base_url}, {owner},
+	// {repo}, {branch}, {commit} and {path} are replaced. kGiteaRawUrlFmt if
+	// not set.
+	UrlFormat string `toml:"url_format,omitempty" mapstructure:"url_format"`
+	// PinCommit makes the default url point to the commit of the upload
+	// instead of the branch
+	PinCommit bool `toml:"pin_commit,omitempty" mapstructure:"pin_commit"`
+}
+
+const (
+	kGiteaRawUrlFmt       = "{base_url}/{owner}/{repo}/raw/branch/{branch}/{path}"
+	kGiteaPinnedRawUrlFmt = "{base_url}/{owner}/{repo}/raw/commit/{commit}/{path}"
+)
+
+// Validate checks fields not covered by validator tags
+func (c GiteaConfig) Validate() error {
+	if err := validConflictPolicy(c.OnConflict); err != nil {
+		return errors.New("gitea: " + err.Error())
+	}
+	if _, err := neturl.Parse(withScheme(c.BaseUrl)); err != nil {
+		return errors.New("gitea: " + err.Error())
+	}
+	return nil
+}
+
+func (c GiteaConfig) baseUrl() string {
+	return strings.TrimSuffix(withScheme(c.BaseUrl), "/")
+}
+
+func (c GiteaConfig) urlFormat() string {
+	if c.UrlFormat != "" {
+		return c.UrlFormat
+	}
+	if c.PinCommit {
+		return kGiteaPinnedRawUrlFmt
+	}
+	return kGiteaRawUrlFmt
+}
+
+// GiteaUploader commits files to a Gitea or Forgejo repository through its
+// contents API
+type GiteaUploader struct {
+	Config  GiteaConfig
+	Options xapp.UploaderOptions
+
+	api forgeClient
+
+	mu sync.Mutex
+	// defaultBranch is the default branch of the repository, looked up once
+	// if Branch is not set
+	defaultBranch string
+}
+
+func NewGiteaUploader(cfg GiteaConfig, opts xapp.UploaderOptions) *GiteaUploader {
+	return &GiteaUploader{
+		Config:  cfg,
+		Options: opts,
+		api: forgeClient{
+			Options: opts,
+			header:  http.Header{"Authorization": {"token " + cfg.Token}},
+		},
+	}
+}
+
+func (u *GiteaUploader) Upload(t *model.Task) error {
+	return u.UploadContext(context.Background(), t)
+}
+
+func (u *GiteaUploader) UploadContext(ctx context.Context, t *model.Task) error {
+	t.Repo = u.Config.Owner + "/" + u.Config.Repo
+	return uploadContents(ctx, u, forgeOptions{
+		OnConflict:    u.Config.OnConflict,
+		CommitMessage: u.Config.CommitMessage,
+		Pinned:        strings.Contains(u.Config.urlFormat(), "{commit}"),
+	}, u.Options, t)
+}
+
+// repoUrl returns api url of the repository followed by path
+func (u *GiteaUploader) repoUrl(path string) string {
+	url := u.Config.baseUrl() + "/api/v1/repos/" + neturl.PathEscape(u.Config.Owner) + "/" + neturl.PathEscape(u.Config.Repo)
+	if path != "" {
+		url += "/" + path
+	}
+	return url
+}
+
+// lookupBranch asks the api for the default branch of the repository if
+// Branch is not set. It is done once, before the first upload.
+func (u *GiteaUploader) lookupBranch(ctx context.Context) error {
+	if u.Config.Branch != "" {
+		return nil
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.defaultBranch != "" {
+		return nil
+	}
+	var repo struct {
+		DefaultBranch string `json:"default_branch"`
+	}
+	if err := u.api.do(ctx, http.MethodGet, u.repoUrl(""), nil, 0, &repo); err != nil {
+		return err
+	}
+	if repo.DefaultBranch == "" {
+		return xretry.Fatal(errors.New("gitea: repository has no default branch, set branch"))
+	}
+	u.defaultBranch = repo.DefaultBranch
+	return nil
+}
+
+// branch returns the branch to commit to
+func (u *GiteaUploader) branch() string {
+	if u.Config.Branch != "" {
+		return u.Config.Branch
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.defaultBranch
+}
+
+func (u *GiteaUploader) stat(ctx context.Context, path string) (string, error) {
+	if err := u.lookupBranch(ctx); err != nil {
+		return "", err
+	}
+	var file struct {
+		Type string `json:"type"`
+		Sha  string `json:"sha"`
+	}
+	url := u.repoUrl("contents/"+xhttp.EscapePath(path)) + "?ref=" + neturl.QueryEscape(u.branch())
+	err := u.api.do(ctx, http.MethodGet, url, nil, 0, &file)
+	var apiErr *apiError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if file.Type != "file" {
+		return "", xretry.Fatal(fmt.Errorf("%s is a %s", path, file.Type))
+	}
+	return file.Sha, nil
+}
+
+// put creates a file with POST, or replaces one with PUT as Gitea requires
+func (u *GiteaUploader) put(ctx context.Context, message, localPath, path, sha string) (string, error) {
+	method := http.MethodPost
+	fields := map[string]string{"branch": u.branch(), "message": message}
+	if sha != "" {
+		method = http.MethodPut
+		fields["sha"] = sha
+	}
+	var ret struct {
+		Commit struct {
+			Sha string `json:"sha"`
+		} `json:"commit"`
+	}
+	err := u.api.putFile(ctx, method, u.repoUrl("contents/"+xhttp.EscapePath(path)), fields, localPath, &ret)
+	return ret.Commit.Sha, err
+}
+
+// lastCommit returns the branch head, which holds every file of the branch
+func (u *GiteaUploader) lastCommit(ctx context.Context, path string) (string, error) {
+	var branch struct {
+		Commit struct {
+			ID string `json:"id"`
+		} `json:"commit"`
+	}
+	err := u.api.do(ctx, http.MethodGet, u.repoUrl("branches/"+xhttp.EscapePath(u.branch())), nil, 0, &branch)
+	return branch.Commit.ID, err
+}
+
+func (u *GiteaUploader) rawUrl(path, commit string) string {
+	return forgeUrl(u.Config.urlFormat(),
+		"{base_url}", u.Config.baseUrl(),
+		"{owner}", u.Config.Owner,
+		"{repo}", u.Config.Repo,
+		"{branch}", u.branch(),
+		"{commit}", commit,
+		"{path}", xhttp.EscapePath(path),
+	)
+}
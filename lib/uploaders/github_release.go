@@ -0,0 +1,291 @@
+package uploaders
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pluveto/upgit/lib/model"
+	"github.com/pluveto/upgit/lib/xapp"
+	"github.com/pluveto/upgit/lib/xgithub"
+	"github.com/pluveto/upgit/lib/xio"
+	"github.com/pluveto/upgit/lib/xlog"
+	"github.com/pluveto/upgit/lib/xprogress"
+	"github.com/pluveto/upgit/lib/xretry"
+)
+
+// DefaultReleaseTag starts a new release every month, keeping each under
+// the limit of 1000 assets per release
+const DefaultReleaseTag = "upgit-{year}{month}"
+
+// GithubReleaseConfig is the [uploaders.github-release] config. Credentials
+// not set here are taken from [uploaders.github].
+type GithubReleaseConfig struct {
+	PAT      string `toml:"pat,omitempty" mapstructure:"pat" validate:"nonzero"`
+	Username string `toml:"username,omitempty" mapstructure:"username" validate:"nonzero"`
+	Repo     string `toml:"repo,omitempty" mapstructure:"repo" validate:"nonzero"`
+	ApiBase  string `toml:"api_base,omitempty" mapstructure:"api_base"`
+	// Tag of the release to upload to, created if missing. {year}, {month}
+	// and {day} are replaced. DefaultReleaseTag if not set.
+	Tag string `toml:"tag,omitempty" mapstructure:"tag"`
+	// OnConflict is ConflictRename (default), ConflictOverwrite or
+	// ConflictFail for an asset of same name
+	OnConflict string `toml:"on_conflict,omitempty" mapstructure:"on_conflict"`
+}
+
+// Inherit fills credentials not set from config of github uploader
+func (c *GithubReleaseConfig) Inherit(g GithubUploaderConfig) {
+	if c.PAT == "" {
+		c.PAT = g.PAT
+	}
+	if c.Username == "" {
+		c.Username = g.Username
+	}
+	if c.Repo == "" {
+		c.Repo = g.Repo
+	}
+	if c.ApiBase == "" {
+		c.ApiBase = g.ApiBase
+	}
+}
+
+// Validate checks fields not covered by validator tags
+func (c GithubReleaseConfig) Validate() error {
+	switch c.OnConflict {
+	case "", ConflictRename, ConflictOverwrite, ConflictFail:
+		return nil
+	}
+	return errors.New("github-release: unsupported on_conflict " + c.OnConflict)
+}
+
+// GithubReleaseUploader uploads files as assets of a release
+type GithubReleaseUploader struct {
+	Config  GithubReleaseConfig
+	Options xapp.UploaderOptions
+
+	// api sends requests with credentials of Config
+	api *GithubUploader
+
+	mu      sync.Mutex
+	release *xgithub.Release
+	// reserved are asset names picked by uploads of this run
+	reserved map[string]bool
+}
+
+func NewGithubReleaseUploader(cfg GithubReleaseConfig, opts xapp.UploaderOptions) *GithubReleaseUploader {
+	return &GithubReleaseUploader{
+		Config:  cfg,
+		Options: opts,
+		api: &GithubUploader{
+			Config: GithubUploaderConfig{
+				PAT:      cfg.PAT,
+				Username: cfg.Username,
+				Repo:     cfg.Repo,
+				ApiBase:  cfg.ApiBase,
+			},
+			Options: opts,
+		},
+		reserved: make(map[string]bool),
+	}
+}
+
+func (u *GithubReleaseUploader) Upload(t *model.Task) error {
+	return u.UploadContext(context.Background(), t)
+}
+
+func (u *GithubReleaseUploader) UploadContext(ctx context.Context, t *model.Task) error {
+	name := filepath.Base(t.LocalPath)
+	xlog.GVerbose.Info("uploading #TASK_%d %s\n", t.TaskId, t.LocalPath)
+	var asset xgithub.Asset
+	attempts, err := xretry.Do(ctx, u.Options.Retry, func() (err error) {
+		release, err := u.getRelease(ctx)
+		if err != nil {
+			return err
+		}
+		asset, err = u.PutAsset(ctx, release, t.LocalPath, name)
+		return err
+	})
+	t.Attempts = attempts
+	t.Repo = u.Config.Username + "/" + u.Config.Repo
+	if err == nil {
+		t.RawUrl = asset.BrowserDownloadURL
+		t.Url = xapp.ReplaceUrl(t.RawUrl)
+		xlog.GVerbose.Info("successfully uploaded #TASK_%d %s => %s\n", t.TaskId, t.LocalPath, t.Url)
+		t.Status = model.TASK_FINISHED
+	} else {
+		xlog.GVerbose.Info("failed to upload #TASK_%d %s : %s\n", t.TaskId, t.LocalPath, err.Error())
+		t.Status = model.TASK_FAILED
+	}
+	t.FinishTime = time.Now()
+	return err
+}
+
+func (u *GithubReleaseUploader) tag() string {
+	tag := u.Config.Tag
+	if tag == "" {
+		tag = DefaultReleaseTag
+	}
+	now := time.Now()
+	return strings.NewReplacer(
+		"{year}", now.Format("2006"),
+		"{month}", now.Format("01"),
+		"{day}", now.Format("02"),
+	).Replace(tag)
+}
+
+// getRelease returns the release of tag, creating it on first use. It is
+// looked up once per run.
+func (u *GithubReleaseUploader) getRelease(ctx context.Context) (*xgithub.Release, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.release != nil {
+		return u.release, nil
+	}
+	tag := u.tag()
+	var release xgithub.Release
+	err := u.api.do(ctx, http.MethodGet, u.api.buildUrl(kReleaseApiFmt, "tags/"+neturl.PathEscape(tag)), nil, 0, &release)
+	var apiErr *apiError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		xlog.GVerbose.Info("creating release %s", tag)
+		err = u.api.doJSON(ctx, http.MethodPost, strings.TrimSuffix(u.api.buildUrl(kReleaseApiFmt, ""), "/"), map[string]interface{}{
+			"tag_name": tag,
+			"name":     tag,
+			"body":     "Files uploaded by upgit",
+		}, &release)
+	}
+	if err != nil {
+		return nil, err
+	}
+	u.release = &release
+	return u.release, nil
+}
+
+const kReleaseApiFmt = "{api_base}/repos/{username}/{repo}/releases/{path}"
+
+// assets lists current assets of release, by name
+func (u *GithubReleaseUploader) assets(ctx context.Context, release *xgithub.Release) (map[string]xgithub.Asset, error) {
+	ret := make(map[string]xgithub.Asset)
+	for page := 1; ; page++ {
+		var assets []xgithub.Asset
+		path := strconv.FormatInt(release.ID, 10) + "/assets?per_page=100&page=" + strconv.Itoa(page)
+		if err := u.api.do(ctx, http.MethodGet, u.api.buildUrl(kReleaseApiFmt, path), nil, 0, &assets); err != nil {
+			return nil, err
+		}
+		for _, a := range assets {
+			ret[a.Name] = a
+		}
+		if len(assets) < 100 {
+			return ret, nil
+		}
+	}
+}
+
+// pickName decides the asset name to upload to according to on_conflict.
+// replace is the asset to delete first, if any.
+func (u *GithubReleaseUploader) pickName(name string, assets map[string]xgithub.Asset) (ret string, replace *xgithub.Asset, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	policy := u.Config.OnConflict
+	if policy == "" {
+		policy = ConflictRename
+	}
+	taken := func(n string) bool {
+		_, ok := assets[n]
+		return ok || u.reserved[n]
+	}
+	ret = name
+	if taken(name) {
+		switch policy {
+		case ConflictFail:
+			return "", nil, xretry.Fatal(fmt.Errorf("asset %s already exists", name))
+		case ConflictOverwrite:
+			if a, ok := assets[name]; ok {
+				replace = &a
+			}
+		case ConflictRename:
+			ret = ""
+			for i := 1; i <= maxRenames; i++ {
+				if candidate := renamed(name, i); !taken(candidate) {
+					ret = candidate
+					break
+				}
+			}
+			if ret == "" {
+				return "", nil, xretry.Fatal(fmt.Errorf("no free name for %s after %d tries", name, maxRenames))
+			}
+		}
+	}
+	u.reserved[ret] = true
+	return ret, replace, nil
+}
+
+func (u *GithubReleaseUploader) unreserve(name string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.reserved, name)
+}
+
+// PutAsset uploads file at localPath as an asset of release, named name or a
+// free variant of it
+func (u *GithubReleaseUploader) PutAsset(ctx context.Context, release *xgithub.Release, localPath, name string) (asset xgithub.Asset, err error) {
+	assets, err := u.assets(ctx, release)
+	if err != nil {
+		return asset, err
+	}
+	// an asset left by an interrupted upload is never usable
+	if a, ok := assets[name]; ok && a.State != "uploaded" {
+		if err := u.deleteAsset(ctx, a); err != nil {
+			return asset, err
+		}
+		delete(assets, name)
+	}
+	name, replace, err := u.pickName(name, assets)
+	if err != nil {
+		return asset, err
+	}
+	defer func() {
+		if err != nil {
+			u.unreserve(name)
+		}
+	}()
+	if replace != nil {
+		if err := u.deleteAsset(ctx, *replace); err != nil {
+			return asset, err
+		}
+	}
+
+	file, length, err := xio.OpenFile(localPath)
+	if err != nil {
+		return asset, err
+	}
+	defer file.Close()
+	tracker := xprogress.Start(ctx, length)
+	defer func() { tracker.Finish(err) }()
+	// upload_url is a URI template ending with {?name,label}
+	url := release.UploadURL
+	if i := strings.Index(url, "{"); i >= 0 {
+		url = url[:i]
+	}
+	url += "?name=" + neturl.QueryEscape(name)
+	xlog.GVerbose.Trace("POST " + url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, tracker.Reader(file))
+	if err != nil {
+		return asset, err
+	}
+	req.ContentLength = length
+	req.Header.Set("Content-Type", u.Options.Metadata.Resolve(localPath).ContentType)
+	err = u.api.send(req, &asset)
+	return asset, err
+}
+
+func (u *GithubReleaseUploader) deleteAsset(ctx context.Context, a xgithub.Asset) error {
+	xlog.GVerbose.Info("deleting asset %s", a.Name)
+	return u.api.do(ctx, http.MethodDelete, u.api.buildUrl(kReleaseApiFmt, "assets/"+strconv.FormatInt(a.ID, 10)), nil, 0, nil)
+}
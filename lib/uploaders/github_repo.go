@@ -0,0 +1,152 @@
+package uploaders
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/pluveto/upgit/lib/xlog"
+	"github.com/pluveto/upgit/lib/xretry"
+)
+
+// repoInfo is the part of a repository used to pick where to upload
+type repoInfo struct {
+	// Size is in KB
+	Size    int64 `json:"size"`
+	Private bool  `json:"private"`
+}
+
+// prepare picks the repository to upload to and makes sure the branch exists,
+// creating them if allowed. It does the work once, before the first upload.
+func (u *GithubUploader) prepare(ctx context.Context) error {
+	u.prepareMu.Lock()
+	defer u.prepareMu.Unlock()
+	if u.prepared {
+		return nil
+	}
+	repo := u.Config.Repo
+	// private is the visibility of the last repository found
+	private := false
+	for n := 2; ; n++ {
+		info, err := u.repoInfo(ctx, repo)
+		if err != nil {
+			return err
+		}
+		if info == nil {
+			if !u.Config.AutoCreate {
+				return xretry.Fatal(fmt.Errorf("repository %s/%s doesn't exist, create it or set auto_create", u.Config.Username, repo))
+			}
+			if u.Config.Private != nil {
+				private = *u.Config.Private
+			}
+			if err := u.createRepo(ctx, repo, private); err != nil {
+				return err
+			}
+			break
+		}
+		private = info.Private
+		if u.Config.RotateSizeMB <= 0 || info.Size < u.Config.RotateSizeMB*1024 {
+			break
+		}
+		xlog.GVerbose.Info("repository %s/%s is %d MB, passing rotate_size_mb", u.Config.Username, repo, info.Size/1024)
+		repo = fmt.Sprintf("%s-%d", u.Config.Repo, n)
+	}
+	u.mu.Lock()
+	u.repo = repo
+	u.mu.Unlock()
+	if err := u.ensureBranch(ctx); err != nil {
+		return err
+	}
+	u.prepared = true
+	return nil
+}
+
+// repoName returns the repository uploaded to
+func (u *GithubUploader) repoName() string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.repo == "" {
+		return u.Config.Repo
+	}
+	return u.repo
+}
+
+// repoInfo returns info of repository named repo of the user, or nil if there
+// is none
+func (u *GithubUploader) repoInfo(ctx context.Context, repo string) (*repoInfo, error) {
+	var info repoInfo
+	url := u.Config.apiBase() + "/repos/" + u.Config.Username + "/" + repo
+	err := u.do(ctx, http.MethodGet, url, nil, 0, &info)
+	var apiErr *apiError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// createRepo creates a repository of the user, or of the organization if
+// username isn't the owner of the token. It is initialized with a README, as
+// Git Data API doesn't work on empty repositories.
+func (u *GithubUploader) createRepo(ctx context.Context, repo string, private bool) error {
+	var user struct {
+		Login string `json:"login"`
+	}
+	if err := u.do(ctx, http.MethodGet, u.Config.apiBase()+"/user", nil, 0, &user); err != nil {
+		return err
+	}
+	url := u.Config.apiBase() + "/user/repos"
+	if user.Login != u.Config.Username {
+		url = u.Config.apiBase() + "/orgs/" + u.Config.Username + "/repos"
+	}
+	xlog.GVerbose.Info("creating repository %s/%s, private: %v", u.Config.Username, repo, private)
+	return u.doJSON(ctx, http.MethodPost, url, map[string]interface{}{
+		"name":        repo,
+		"description": "Files uploaded by upgit",
+		"private":     private,
+		"auto_init":   true,
+	}, nil)
+}
+
+// ensureBranch creates the branch as an orphan one if it doesn't exist and
+// auto_create is set
+func (u *GithubUploader) ensureBranch(ctx context.Context) error {
+	_, err := u.headCommit(ctx)
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+		return err
+	}
+	if !u.Config.AutoCreate {
+		return xretry.Fatal(fmt.Errorf("branch %s doesn't exist in %s/%s, create it or set auto_create", u.Config.Branch, u.Config.Username, u.repoName()))
+	}
+	xlog.GVerbose.Info("creating branch %s in %s/%s", u.Config.Branch, u.Config.Username, u.repoName())
+	var tree struct {
+		Sha string `json:"sha"`
+	}
+	err = u.doJSON(ctx, http.MethodPost, u.buildUrl(kGitApiFmt, "trees"), map[string]interface{}{
+		"tree": []map[string]string{
+			{"path": ".keep", "mode": "100644", "type": "blob", "content": ""},
+		},
+	}, &tree)
+	if err != nil {
+		return err
+	}
+	var commit struct {
+		Sha string `json:"sha"`
+	}
+	err = u.doJSON(ctx, http.MethodPost, u.buildUrl(kGitApiFmt, "commits"), map[string]interface{}{
+		"message": "create branch " + u.Config.Branch + " via upgit client",
+		"tree":    tree.Sha,
+		"parents": []string{},
+	}, &commit)
+	if err != nil {
+		return err
+	}
+	return u.doJSON(ctx, http.MethodPost, u.buildUrl(kGitApiFmt, "refs"), map[string]interface{}{
+		"ref": "refs/heads/" + u.Config.Branch,
+		"sha": commit.Sha,
+	}, nil)
+}
@@ -0,0 +1,49 @@
+package uploaders
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGithubRotateKeepsPrivate(t *testing.T) {
+	var created map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + strings.TrimPrefix(r.URL.Path, "/api/v3") {
+		case "GET /repos/me/assets":
+			fmt.Fprint(w, `{"size":2000,"private":true}`)
+		case "GET /user":
+			fmt.Fprint(w, `{"login":"me"}`)
+		case "POST /user/repos":
+			json.NewDecoder(r.Body).Decode(&created)
+			fmt.Fprint(w, `{}`)
+		case "GET /repos/me/assets-2/git/ref/heads/main":
+			fmt.Fprint(w, `{"object":{"sha":"c0"}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	public := false
+	for _, tt := range []struct {
+		private *bool
+		want    bool
+	}{{nil, true}, {&public, false}} {
+		created = nil
+		u := &GithubUploader{Config: GithubUploaderConfig{
+			PAT: "secret", Username: "me", Repo: "assets", Branch: "main",
+			ApiBase: server.URL + "/api/v3", AutoCreate: true, RotateSizeMB: 1, Private: tt.private,
+		}}
+		if err := u.prepare(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if created["name"] != "assets-2" || created["private"] != tt.want {
+			t.Errorf("created %v, want private %v", created, tt.want)
+		}
+	}
+}
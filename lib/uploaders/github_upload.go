@@ -2,77 +2,373 @@ package uploaders
 
 import (
 	"bytes"
-
-	"encoding/base64"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	neturl "net/url"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pluveto/upgit/lib/model"
 	"github.com/pluveto/upgit/lib/xapp"
+	"github.com/pluveto/upgit/lib/xgit"
+	"github.com/pluveto/upgit/lib/xhttp"
+	"github.com/pluveto/upgit/lib/xio"
 	"github.com/pluveto/upgit/lib/xlog"
+	"github.com/pluveto/upgit/lib/xprogress"
+	"github.com/pluveto/upgit/lib/xretry"
 )
 
 type UploadOptions struct {
 	LocalPath string
 }
 
+const (
+	// GithubModeContents commits each file through the Contents API
+	GithubModeContents = "contents"
+	// GithubModeGitData uploads files as blobs and commits them all at once
+	// through the Git Data API
+	GithubModeGitData = "gitdata"
+)
+
+// DefaultCommitMessage is the commit message template. {files} is replaced
+// with names of committed files and {count} with their number.
+const DefaultCommitMessage = "upload {files} via upgit client"
+
 type GithubUploaderConfig struct {
-	PAT      string `toml:"pat" validate:"nonzero"`
-	Username string `toml:"username" validate:"nonzero"`
-	Repo     string `toml:"repo" validate:"nonzero"`
-	Branch   string `toml:"branch,omitempty"`
+	PAT      string `toml:"pat" mapstructure:"pat" validate:"nonzero"`
+	Username string `toml:"username" mapstructure:"username" validate:"nonzero"`
+	Repo     string `toml:"repo" mapstructure:"repo" validate:"nonzero"`
+	Branch   string `toml:"branch,omitempty" mapstructure:"branch"`
+	// Mode is GithubModeContents (default) or GithubModeGitData
+	Mode          string `toml:"mode,omitempty" mapstructure:"mode"`
+	CommitMessage string `toml:"commit_message,omitempty" mapstructure:"commit_message"`
+	// OnConflict is the policy for an existing path, DefaultConflictPolicy if not set
+	OnConflict string `toml:"on_conflict,omitempty" mapstructure:"on_conflict"`
+	// UrlFormat is the format of file urls, in which {raw_base}, {username},
+	// {repo}, {branch}, {commit} and {path} are replaced. kRawUrlFmt if not set.
+	UrlFormat string `toml:"url_format,omitempty" mapstructure:"url_format"`
+	// PinCommit makes the default url point to the commit of the upload
+	// instead of the branch, so it never changes
+	PinCommit bool `toml:"pin_commit,omitempty" mapstructure:"pin_commit"`
+	// ApiBase is the REST API root, https://api.github.com if not set. A bare
+	// GitHub Enterprise host like https://ghe.example.com gets /api/v3 appended.
+	ApiBase string `toml:"api_base,omitempty" mapstructure:"api_base"`
+	// RawBase is the root of raw file urls. It defaults to
+	// https://raw.githubusercontent.com, or <host>/raw of an enterprise host.
+	RawBase string `toml:"raw_base,omitempty" mapstructure:"raw_base"`
+	// AutoCreate creates the repository and an orphan branch if missing
+	AutoCreate bool `toml:"auto_create,omitempty" mapstructure:"auto_create"`
+	// Private is the visibility of created repositories. It defaults to the
+	// one of the repository passing rotate_size_mb, or public if there is none.
+	Private *bool `toml:"private,omitempty" mapstructure:"private"`
+	// RotateSizeMB moves uploads to repo-2, repo-3 ... once the repository
+	// grows past it. 0 disables rotation.
+	RotateSizeMB int64 `toml:"rotate_size_mb,omitempty" mapstructure:"rotate_size_mb"`
+}
+
+const (
+	kDefaultApiBase = "https://api.github.com"
+	kDefaultRawBase = "https://raw.githubusercontent.com"
+)
+
+// enterpriseHost returns the scheme and host of ApiBase if it is a GitHub
+// Enterprise Server, or "" for github.com
+func (c GithubUploaderConfig) enterpriseHost() string {
+	if c.ApiBase == "" {
+		return ""
+	}
+	base := withScheme(c.ApiBase)
+	u, err := neturl.Parse(base)
+	if err != nil || u.Host == "api.github.com" {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+func (c GithubUploaderConfig) apiBase() string {
+	if c.ApiBase == "" {
+		return kDefaultApiBase
+	}
+	base := strings.TrimSuffix(withScheme(c.ApiBase), "/")
+	if host := c.enterpriseHost(); host != "" && base == host {
+		return host + "/api/v3"
+	}
+	return base
+}
+
+func (c GithubUploaderConfig) rawBase() string {
+	if c.RawBase != "" {
+		return strings.TrimSuffix(withScheme(c.RawBase), "/")
+	}
+	if host := c.enterpriseHost(); host != "" {
+		return host + "/raw"
+	}
+	return kDefaultRawBase
+}
+
+func withScheme(base string) string {
+	if !strings.Contains(base, "://") {
+		return "https://" + base
+	}
+	return base
+}
+
+// Validate checks fields not covered by validator tags
+func (c GithubUploaderConfig) Validate() error {
+	switch c.Mode {
+	case "", GithubModeContents, GithubModeGitData:
+	default:
+		return errors.New("github: unknown mode " + c.Mode)
+	}
+	if err := validConflictPolicy(c.OnConflict); err != nil {
+		return errors.New("github: " + err.Error())
+	}
+	if c.RotateSizeMB < 0 {
+		return errors.New("github: rotate_size_mb must not be negative")
+	}
+	for _, base := range []string{c.ApiBase, c.RawBase} {
+		if base == "" {
+			continue
+		}
+		if _, err := neturl.Parse(withScheme(base)); err != nil {
+			return errors.New("github: " + err.Error())
+		}
+	}
+	return nil
 }
+
 type GithubUploader struct {
-	Config GithubUploaderConfig
+	Config  GithubUploaderConfig
+	Options xapp.UploaderOptions
+
+	mu sync.Mutex
+	// staged are blobs waiting for Flush in gitdata mode
+	staged []stagedFile
+	// stageMu makes resolving the path of a file and staging it atomic, so
+	// that files of a batch never take the same path
+	stageMu sync.Mutex
+	// repo is the repository picked by prepare, which differs from
+	// Config.Repo after rotation
+	repo string
+
+	prepareMu sync.Mutex
+	prepared  bool
+}
+
+type stagedFile struct {
+	Path string
+	Sha  string
+	// Task gets urls once the commit is made
+	Task *model.Task
+}
+
+type treeEntry struct {
+	Path string `json:"path"`
+	Mode string `json:"mode"`
+	Type string `json:"type"`
+	Sha  string `json:"sha"`
 }
 
-const kRawUrlFmt = "https://raw.githubusercontent.com/{username}/{repo}/{branch}/{path}"
-const kApiFmt = "https://api.github.com/repos/{username}/{repo}/contents/{path}"
+const kRawUrlFmt = "{raw_base}/{username}/{repo}/{branch}/{path}"
+const kPinnedRawUrlFmt = "{raw_base}/{username}/{repo}/{commit}/{path}"
+const kApiFmt = "{api_base}/repos/{username}/{repo}/contents/{path}"
+const kGitApiFmt = "{api_base}/repos/{username}/{repo}/git/{path}"
 
-func (u GithubUploader) PutFile(message, path, name string) (err error) {
-	dat, err := ioutil.ReadFile(path)
+// maxRefUpdates limits attempts to move the branch when others push to it
+// at the same time
+const maxRefUpdates = 3
+
+// contentBody streams the json body of a content request. File content is
+// base64 encoded while sending, so it is never held in memory. sha is the one
+// of the file to replace, if any.
+func (u *GithubUploader) contentBody(message, path, sha string) (body io.ReadCloser, length int64, err error) {
+	branch, _ := json.Marshal(u.Config.Branch)
+	msg, _ := json.Marshal(message)
+	head := `{"branch":` + string(branch) + `,"message":` + string(msg)
+	if sha != "" {
+		head += `,"sha":"` + sha + `"`
+	}
+	return base64JSONBody(head+`,"content":"`, path, `"}`)
+}
+
+// base64JSONBody streams head, base64 encoded content of file at path, and tail
+func base64JSONBody(head, path, tail string) (body io.ReadCloser, length int64, err error) {
+	file, size, err := xio.OpenFile(path)
 	if err != nil {
-		return err
+		return nil, 0, err
 	}
-	encoded := base64.StdEncoding.EncodeToString(dat)
-	url := u.buildUrl(kApiFmt, name)
-	xlog.GVerbose.Trace("PUT " + url)
-	req, err := http.NewRequest(http.MethodPut, url, bytes.NewBufferString(
-		`{
-			"branch": "`+u.Config.Branch+`",
-			"message": "`+message+`",
-			"content": "`+encoded+`"
-		}`))
+	length = int64(len(head)) + xio.Base64Len(size) + int64(len(tail))
+	body = xio.MultiReadCloser(strings.NewReader(head), xio.Base64Reader(file), strings.NewReader(tail))
+	return body, length, nil
+}
+
+// do sends an api request and decodes json response into out if it isn't nil
+func (u *GithubUploader) do(ctx context.Context, method, url string, body io.Reader, length int64, out interface{}) error {
+	xlog.GVerbose.Trace(method + " " + url)
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
 	if err != nil {
 		return err
 	}
-	req.Header.Set("User-Agent", xapp.UserAgent)
+	if body != nil {
+		req.ContentLength = length
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return u.send(req, out)
+}
+
+// send sets auth headers of req, sends it and decodes json response into out
+// if it isn't nil
+func (u *GithubUploader) send(req *http.Request, out interface{}) error {
 	req.Header.Set("Accept", "application/vnd.github.v3+json")
-	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", "token "+u.Config.PAT)
-	resp, err := http.DefaultClient.Do(req)
+	return sendRequest(u.Options.HTTPClient(), req, out)
+}
+
+// sendRequest sends an api request and decodes json response into out if it
+// isn't nil. A failed request returns an *apiError.
+func sendRequest(client *http.Client, req *http.Request, out interface{}) error {
+	req.Header.Set("User-Agent", xapp.UserAgent)
+	resp, err := client.Do(req)
 	if err != nil {
 		return err
 	}
-	body, err := ioutil.ReadAll(resp.Body)
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return err
 	}
-	xlog.GVerbose.Trace("response body: " + string(body))
-	if strings.Contains(string(body), "\\\"sha\\\" wasn't supplied.") {
-		return nil
+	xlog.GVerbose.Trace("response body: " + string(respBody))
+	if err := xretry.CheckResponse(resp, respBody); err != nil {
+		return &apiError{StatusCode: resp.StatusCode, Err: err}
 	}
-	if !(200 <= resp.StatusCode && resp.StatusCode < 300) {
-		return fmt.Errorf("unexpected status code %d. response: %s", resp.StatusCode, string(body))
+	if out != nil {
+		return json.Unmarshal(respBody, out)
 	}
 	return nil
 }
 
-func (u GithubUploader) Upload(t *model.Task) error {
+// doJSON sends in as json body of an api request
+func (u *GithubUploader) doJSON(ctx context.Context, method, url string, in, out interface{}) error {
+	buf, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return u.do(ctx, method, url, bytes.NewReader(buf), int64(len(buf)), out)
+}
+
+// apiError keeps status code of a failed api request
+type apiError struct {
+	StatusCode int
+	Err        error
+}
+
+func (e *apiError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *apiError) Unwrap() error {
+	return e.Err
+}
+
+// PutFile commits file at path to name and returns sha of the commit. sha
+// is the one of the file to replace, or empty to create a new file.
+func (u *GithubUploader) PutFile(ctx context.Context, message, path, name, sha string) (commit string, err error) {
+	url := u.buildUrl(kApiFmt, xhttp.EscapePath(name))
+	xlog.GVerbose.Trace("PUT " + url)
+	body, length, err := u.contentBody(message, path, sha)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	tracker := xprogress.Start(ctx, length)
+	defer func() { tracker.Finish(err) }()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, tracker.ReadCloser(body))
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = length
+	req.Header.Set("User-Agent", xapp.UserAgent)
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "token "+u.Config.PAT)
+	resp, err := u.Options.HTTPClient().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	xlog.GVerbose.Trace("response body: " + string(respBody))
+	if err := xretry.CheckResponse(resp, respBody); err != nil {
+		return "", err
+	}
+	var ret struct {
+		Commit struct {
+			Sha string `json:"sha"`
+		} `json:"commit"`
+	}
+	if err := json.Unmarshal(respBody, &ret); err != nil {
+		return "", err
+	}
+	return ret.Commit.Sha, nil
+}
+
+// stat returns git blob sha of the file at path on the branch, including
+// files staged in this run, or "" if there is none
+func (u *GithubUploader) stat(ctx context.Context, path string) (string, error) {
+	if sha, ok := u.stagedSha(path); ok {
+		return sha, nil
+	}
+	var file struct {
+		Type string `json:"type"`
+		Sha  string `json:"sha"`
+	}
+	url := u.buildUrl(kApiFmt, xhttp.EscapePath(path)) + "?ref=" + neturl.QueryEscape(u.Config.Branch)
+	err := u.do(ctx, http.MethodGet, url, nil, 0, &file)
+	var apiErr *apiError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if file.Type != "file" {
+		return "", xretry.Fatal(fmt.Errorf("%s is a %s", path, file.Type))
+	}
+	return file.Sha, nil
+}
+
+// PutBlob uploads file at path as a blob and returns its sha
+func (u *GithubUploader) PutBlob(ctx context.Context, path string) (sha string, err error) {
+	body, length, err := base64JSONBody(`{"encoding":"base64","content":"`, path, `"}`)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	tracker := xprogress.Start(ctx, length)
+	defer func() { tracker.Finish(err) }()
+	var blob struct {
+		Sha string `json:"sha"`
+	}
+	err = u.do(ctx, http.MethodPost, u.buildUrl(kGitApiFmt, "blobs"), tracker.ReadCloser(body), length, &blob)
+	return blob.Sha, err
+}
+
+func (u *GithubUploader) Upload(t *model.Task) error {
+	return u.UploadContext(context.Background(), t)
+}
+
+func (u *GithubUploader) UploadContext(ctx context.Context, t *model.Task) error {
 	now := time.Now()
 	base := filepath.Base(t.LocalPath)
 	// TODO: USE reference
@@ -82,27 +378,290 @@ func (u GithubUploader) Upload(t *model.Task) error {
 	} else {
 		targetPath = xapp.Rename(base, now)
 	}
-	rawUrl := u.buildUrl(kRawUrlFmt, targetPath)
-	url := xapp.ReplaceUrl(rawUrl)
 	xlog.GVerbose.Info("uploading #TASK_%d %s\n", t.TaskId, t.LocalPath)
-	// var err error
-	err := u.PutFile("upload "+base+" via upgit client", t.LocalPath, targetPath)
+	policy := u.Config.OnConflict
+	if policy == "" {
+		policy = DefaultConflictPolicy
+	}
+	// each attempt resolves targetPath again, as paths may be taken meanwhile
+	resolved := targetPath
+	var commit string
+	attempts, err := xretry.Do(ctx, u.Options.Retry, func() (err error) {
+		if err := u.prepare(ctx); err != nil {
+			return err
+		}
+		var c conflict
+		if u.Config.Mode == GithubModeGitData {
+			c, err = u.reserve(ctx, policy, t, targetPath)
+		} else {
+			c, err = resolveConflict(ctx, policy, t.LocalPath, targetPath, u.stat)
+		}
+		if err != nil {
+			return err
+		}
+		resolved = c.Path
+		if c.Identical {
+			xlog.GVerbose.Info("skipped #TASK_%d %s: identical to %s", t.TaskId, t.LocalPath, c.Path)
+			// a file identical to a staged one gets urls by Flush
+			if u.pinned() && !u.isStaged(t) {
+				commit, err = u.headCommit(ctx)
+			}
+			return err
+		}
+		if u.Config.Mode == GithubModeGitData {
+			return u.putStagedBlob(ctx, t)
+		}
+		commit, err = u.PutFile(ctx, u.commitMessage([]string{base}), t.LocalPath, resolved, c.Sha)
+		return err
+	})
+	t.Attempts = attempts
+	t.Repo = u.Config.Username + "/" + u.repoName()
+	// in gitdata mode the commit is unknown until Flush, which sets urls again
+	u.setUrls(t, resolved, commit)
 	if err == nil {
-		xlog.GVerbose.Info("sucessfully uploaded #TASK_%d %s => %s\n", t.TaskId, t.LocalPath, url)
+		xlog.GVerbose.Info("sucessfully uploaded #TASK_%d %s => %s\n", t.TaskId, t.LocalPath, t.Url)
 	} else {
 		xlog.GVerbose.Info("failed to upload #TASK_%d %s : %s\n", t.TaskId, t.LocalPath, err.Error())
 	}
 	t.Status = model.TASK_FINISHED
-	t.Url = url
 	t.FinishTime = time.Now()
-	t.RawUrl = rawUrl
 	return err
 }
 
-func (u GithubUploader) buildUrl(urlfmt, path string) string {
+// reserve resolves the path of task t and stages it at once, with the blob
+// sha computed locally. A file identical to a staged one is staged too, as it
+// gets urls by Flush. The blob is uploaded by putStagedBlob after.
+func (u *GithubUploader) reserve(ctx context.Context, policy string, t *model.Task, path string) (conflict, error) {
+	u.stageMu.Lock()
+	defer u.stageMu.Unlock()
+	c, err := resolveConflict(ctx, policy, t.LocalPath, path, u.stat)
+	if err != nil {
+		return c, err
+	}
+	if _, staged := u.stagedSha(c.Path); c.Identical && !staged {
+		return c, nil
+	}
+	sha, err := xgit.BlobSHA(t.LocalPath)
+	if err != nil {
+		return c, err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.staged = append(u.staged, stagedFile{Path: c.Path, Sha: sha, Task: t})
+	return c, nil
+}
+
+// putStagedBlob uploads the blob of task t staged by reserve. The task is
+// unstaged if it fails, so that a retry resolves its path again.
+func (u *GithubUploader) putStagedBlob(ctx context.Context, t *model.Task) error {
+	sha, err := u.PutBlob(ctx, t.LocalPath)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for i, f := range u.staged {
+		if f.Task != t {
+			continue
+		}
+		if err == nil && sha != f.Sha {
+			err = xretry.Fatal(fmt.Errorf("blob sha %s of %s differs from %s", sha, t.LocalPath, f.Sha))
+		}
+		if err != nil {
+			u.staged = append(u.staged[:i], u.staged[i+1:]...)
+		}
+		break
+	}
+	return err
+}
+
+// stagedSha returns sha of the last file staged at path
+func (u *GithubUploader) stagedSha(path string) (string, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for i := len(u.staged) - 1; i >= 0; i-- {
+		if u.staged[i].Path == path {
+			return u.staged[i].Sha, true
+		}
+	}
+	return "", false
+}
+
+// isStaged tells whether task t is staged
+func (u *GithubUploader) isStaged(t *model.Task) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, f := range u.staged {
+		if f.Task == t {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *GithubUploader) urlFormat() string {
+	if u.Config.UrlFormat != "" {
+		return u.Config.UrlFormat
+	}
+	if u.Config.PinCommit {
+		return kPinnedRawUrlFmt
+	}
+	return kRawUrlFmt
+}
+
+// pinned tells whether urls contain the commit of the upload
+func (u *GithubUploader) pinned() bool {
+	return strings.Contains(u.urlFormat(), "{commit}")
+}
+
+// setUrls sets urls of task t uploaded to path in commit
+func (u *GithubUploader) setUrls(t *model.Task, path, commit string) {
+	t.RawUrl = strings.ReplaceAll(u.buildUrl(u.urlFormat(), path), "{commit}", commit)
+	t.Url = xapp.ReplaceUrl(t.RawUrl)
+}
+
+// commitMessage fills the commit message template with names of files
+func (u *GithubUploader) commitMessage(names []string) string {
+	return commitMessage(u.Config.CommitMessage, names)
+}
+
+// commitMessage fills message template, DefaultCommitMessage if empty, with
+// names of committed files
+func commitMessage(message string, names []string) string {
+	if message == "" {
+		message = DefaultCommitMessage
+	}
+	return strings.NewReplacer(
+		"{files}", strings.Join(names, ", "),
+		"{count}", strconv.Itoa(len(names)),
+	).Replace(message)
+}
+
+// GithubBatchUploader is a model.BatchUploader of a GithubUploader in
+// gitdata mode
+type GithubBatchUploader struct {
+	*GithubUploader
+}
+
+// Flush commits blobs staged by uploading to the branch in one commit
+func (u GithubBatchUploader) Flush(ctx context.Context) ([]*model.Task, error) {
+	return u.flush(ctx)
+}
+
+func (u *GithubUploader) flush(ctx context.Context) ([]*model.Task, error) {
+	u.mu.Lock()
+	staged := u.staged
+	u.staged = nil
+	u.mu.Unlock()
+	if len(staged) == 0 {
+		return nil, nil
+	}
+	tasks := make([]*model.Task, len(staged))
+	for i, f := range staged {
+		tasks[i] = f.Task
+	}
+	// files of the same path must be identical, as one would silently
+	// replace the other
+	var entries []treeEntry
+	first := make(map[string]stagedFile)
+	for _, f := range staged {
+		if g, ok := first[f.Path]; ok {
+			if g.Sha != f.Sha {
+				return tasks, fmt.Errorf("%s and %s are both staged at %s", g.Task.LocalPath, f.Task.LocalPath, f.Path)
+			}
+			continue
+		}
+		first[f.Path] = f
+		entries = append(entries, treeEntry{Path: f.Path, Mode: "100644", Type: "blob", Sha: f.Sha})
+	}
+	names := make([]string, len(entries))
+	for i, e := range entries {
+		names[i] = filepath.Base(e.Path)
+	}
+	message := u.commitMessage(names)
+
+	var commit string
+	var err error
+	for i := 0; i < maxRefUpdates; i++ {
+		_, err = xretry.Do(ctx, u.Options.Retry, func() (err error) {
+			commit, err = u.commit(ctx, message, entries)
+			return err
+		})
+		// 422 means the branch has moved since reading it, so try again on
+		// top of the new head
+		var apiErr *apiError
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnprocessableEntity {
+			break
+		}
+		xlog.GVerbose.Info("branch %s moved while committing, retrying", u.Config.Branch)
+	}
+	if err != nil {
+		return tasks, err
+	}
+	for _, f := range staged {
+		u.setUrls(f.Task, f.Path, commit)
+	}
+	return tasks, nil
+}
+
+// headCommit returns sha of the commit the branch points to
+func (u *GithubUploader) headCommit(ctx context.Context) (string, error) {
+	var ref struct {
+		Object struct {
+			Sha string `json:"sha"`
+		} `json:"object"`
+	}
+	err := u.do(ctx, http.MethodGet, u.buildUrl(kGitApiFmt, "ref/heads/"+u.Config.Branch), nil, 0, &ref)
+	return ref.Object.Sha, err
+}
+
+// commit makes a commit of entries on top of the branch head, moves the
+// branch to it and returns its sha
+func (u *GithubUploader) commit(ctx context.Context, message string, entries []treeEntry) (string, error) {
+	parent, err := u.headCommit(ctx)
+	if err != nil {
+		return "", err
+	}
+	var head struct {
+		Tree struct {
+			Sha string `json:"sha"`
+		} `json:"tree"`
+	}
+	if err := u.do(ctx, http.MethodGet, u.buildUrl(kGitApiFmt, "commits/"+parent), nil, 0, &head); err != nil {
+		return "", err
+	}
+
+	var tree struct {
+		Sha string `json:"sha"`
+	}
+	err = u.doJSON(ctx, http.MethodPost, u.buildUrl(kGitApiFmt, "trees"), map[string]interface{}{
+		"base_tree": head.Tree.Sha,
+		"tree":      entries,
+	}, &tree)
+	if err != nil {
+		return "", err
+	}
+	var commit struct {
+		Sha string `json:"sha"`
+	}
+	err = u.doJSON(ctx, http.MethodPost, u.buildUrl(kGitApiFmt, "commits"), map[string]interface{}{
+		"message": message,
+		"tree":    tree.Sha,
+		"parents": []string{parent},
+	}, &commit)
+	if err != nil {
+		return "", err
+	}
+	xlog.GVerbose.Info("created commit %s with %d files", commit.Sha, len(entries))
+	err = u.doJSON(ctx, http.MethodPatch, u.buildUrl(kGitApiFmt, "refs/heads/"+u.Config.Branch), map[string]interface{}{
+		"sha": commit.Sha,
+	}, nil)
+	return commit.Sha, err
+}
+
+func (u *GithubUploader) buildUrl(urlfmt, path string) string {
 	r := strings.NewReplacer(
+		"{api_base}", u.Config.apiBase(),
+		"{raw_base}", u.Config.rawBase(),
 		"{username}", u.Config.Username,
-		"{repo}", u.Config.Repo,
+		"{repo}", u.repoName(),
 		"{branch}", u.Config.Branch,
 		"{path}", path,
 	)
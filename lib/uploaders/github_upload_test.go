@@ -0,0 +1,123 @@
+package uploaders
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pluveto/upgit/lib/model"
+	"github.com/pluveto/upgit/lib/xgit"
+)
+
+// contentSha returns git blob sha of content
+func contentSha(t *testing.T, content string) string {
+	p := filepath.Join(t.TempDir(), "blob")
+	if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sha, err := xgit.BlobSHA(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sha
+}
+
+// fakeGitData serves the Git Data API of an empty branch main of me/assets
+type fakeGitData struct {
+	t  *testing.T
+	mu sync.Mutex
+	// trees are entries of the trees created
+	trees [][]treeEntry
+}
+
+func (f *fakeGitData) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/api/v3/repos/me/assets")
+	switch {
+	case path == "":
+		fmt.Fprint(w, `{"size":1}`)
+	case path == "/git/ref/heads/main":
+		fmt.Fprint(w, `{"object":{"sha":"c0"}}`)
+	case path == "/git/commits/c0":
+		fmt.Fprint(w, `{"tree":{"sha":"t0"}}`)
+	case strings.HasPrefix(path, "/contents/"):
+		http.NotFound(w, r)
+	case path == "/git/blobs":
+		var blob struct{ Content string }
+		json.NewDecoder(r.Body).Decode(&blob)
+		buf, err := base64.StdEncoding.DecodeString(blob.Content)
+		if err != nil {
+			f.t.Error(err)
+		}
+		fmt.Fprintf(w, `{"sha":"%s"}`, contentSha(f.t, string(buf)))
+	case path == "/git/trees":
+		var tree struct{ Tree []treeEntry }
+		json.NewDecoder(r.Body).Decode(&tree)
+		f.trees = append(f.trees, tree.Tree)
+		fmt.Fprint(w, `{"sha":"t1"}`)
+	case path == "/git/commits":
+		fmt.Fprint(w, `{"sha":"c1"}`)
+	case path == "/git/refs/heads/main":
+		fmt.Fprint(w, `{}`)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestGithubGitDataSameName(t *testing.T) {
+	api := &fakeGitData{t: t}
+	server := httptest.NewServer(api)
+	defer server.Close()
+	write := func(dir, content string) string {
+		p := filepath.Join(t.TempDir(), dir, "a.png")
+		os.MkdirAll(filepath.Dir(p), 0755)
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	batch := func(policy string, contents ...string) ([]*model.Task, error) {
+		u := GithubBatchUploader{&GithubUploader{Config: GithubUploaderConfig{
+			PAT: "secret", Username: "me", Repo: "assets", Branch: "main",
+			Mode: GithubModeGitData, OnConflict: policy, ApiBase: server.URL + "/api/v3",
+		}}}
+		var tasks []*model.Task
+		for i, content := range contents {
+			task := &model.Task{TaskId: i, LocalPath: write(fmt.Sprint(i), content), TargetDir: "img"}
+			if err := u.UploadContext(context.Background(), task); err != nil {
+				t.Fatal(err)
+			}
+			tasks = append(tasks, task)
+		}
+		_, err := u.Flush(context.Background())
+		return tasks, err
+	}
+
+	tasks, err := batch(ConflictRename, "one", "two", "one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := api.trees[len(api.trees)-1]
+	if len(tree) != 2 || tree[0].Path != "img/a.png" || tree[1].Path != "img/a_1.png" {
+		t.Errorf("tree %+v, want img/a.png and img/a_1.png", tree)
+	}
+	for i, want := range []string{"img/a.png", "img/a_1.png", "img/a.png"} {
+		if !strings.HasSuffix(tasks[i].RawUrl, "/main/"+want) {
+			t.Errorf("url of file %d = %s, want one of %s", i, tasks[i].RawUrl, want)
+		}
+	}
+
+	// a later file of the same path must not silently replace the first
+	if _, err := batch(ConflictOverwrite, "one", "two"); err == nil {
+		t.Error("overwriting a file of the same batch should fail")
+	}
+}
@@ -0,0 +1,246 @@
+package uploaders
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	neturl "net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pluveto/upgit/lib/model"
+	"github.com/pluveto/upgit/lib/xapp"
+	"github.com/pluveto/upgit/lib/xhttp"
+	"github.com/pluveto/upgit/lib/xretry"
+)
+
+// DefaultGitlabBaseUrl is the instance used when base_url is not set
+const DefaultGitlabBaseUrl = "https://gitlab.com"
+
+// GitlabConfig is the [uploaders.gitlab] config
+type GitlabConfig struct {
+	// BaseUrl is the root of the instance, DefaultGitlabBaseUrl if not set
+	BaseUrl string `toml:"base_url,omitempty" mapstructure:"base_url"`
+	Token   string `toml:"token" mapstructure:"token" validate:"nonzero"`
+	// Project is the path of the project like group/subgroup/project, or its
+	// numeric id
+	Project string `toml:"project" mapstructure:"project" validate:"nonzero"`
+	// Branch is the default branch of the project if not set
+	Branch string `toml:"branch,omitempty" mapstructure:"branch"`
+	// CommitMessage is a template like DefaultCommitMessage
+	CommitMessage string `toml:"commit_message,omitempty" mapstructure:"commit_message"`
+	// OnConflict is the policy for an existing path, DefaultConflictPolicy if not set
+	OnConflict string `toml:"on_conflict,omitempty" mapstructure:"on_conflict"`
+	// UrlFormat is the format of file urls, in which {base_url}, {project},
+	// {branch}, {commit} and {path} are replaced. kGitlabRawUrlFmt if not set.
+	UrlFormat string `toml:"url_format,omitempty" mapstructure:"url_format"`
+	// PinCommit makes the default url point to the commit of the upload
+	// instead of the branch
+	PinCommit bool `toml:"pin_commit,omitempty" mapstructure:"pin_commit"`
+}
+
+const (
+	kGitlabRawUrlFmt       = "{base_url}/{project}/-/raw/{branch}/{path}"
+	kGitlabPinnedRawUrlFmt = "{base_url}/{project}/-/raw/{commit}/{path}"
+)
+
+// Validate checks fields not covered by validator tags
+func (c GitlabConfig) Validate() error {
+	if err := validConflictPolicy(c.OnConflict); err != nil {
+		return errors.New("gitlab: " + err.Error())
+	}
+	if _, err := neturl.Parse(withScheme(c.BaseUrl)); err != nil {
+		return errors.New("gitlab: " + err.Error())
+	}
+	return nil
+}
+
+func (c GitlabConfig) baseUrl() string {
+	if c.BaseUrl == "" {
+		return DefaultGitlabBaseUrl
+	}
+	return strings.TrimSuffix(withScheme(c.BaseUrl), "/")
+}
+
+func (c GitlabConfig) urlFormat() string {
+	if c.UrlFormat != "" {
+		return c.UrlFormat
+	}
+	if c.PinCommit {
+		return kGitlabPinnedRawUrlFmt
+	}
+	return kGitlabRawUrlFmt
+}
+
+// GitlabUploader commits files to a GitLab project through its repository
+// files API
+type GitlabUploader struct {
+	Config  GitlabConfig
+	Options xapp.UploaderOptions
+
+	api forgeClient
+
+	mu sync.Mutex
+	// projectPath is the path of a project configured by id, looked up once
+	// for raw urls
+	projectPath string
+	// defaultBranch is the default branch of the project, looked up once if
+	// Branch is not set
+	defaultBranch string
+}
+
+func NewGitlabUploader(cfg GitlabConfig, opts xapp.UploaderOptions) *GitlabUploader {
+	return &GitlabUploader{
+		Config:  cfg,
+		Options: opts,
+		api: forgeClient{
+			Options: opts,
+			header:  http.Header{"Private-Token": {cfg.Token}},
+		},
+	}
+}
+
+func (u *GitlabUploader) Upload(t *model.Task) error {
+	return u.UploadContext(context.Background(), t)
+}
+
+func (u *GitlabUploader) UploadContext(ctx context.Context, t *model.Task) error {
+	err := uploadContents(ctx, u, forgeOptions{
+		OnConflict:    u.Config.OnConflict,
+		CommitMessage: u.Config.CommitMessage,
+		Pinned:        strings.Contains(u.Config.urlFormat(), "{commit}"),
+	}, u.Options, t)
+	t.Repo = u.projectName()
+	return err
+}
+
+// lookupProject asks the api for path of a project configured by id, and
+// for its default branch if Branch is not set. It is done once, before the
+// first upload.
+func (u *GitlabUploader) lookupProject(ctx context.Context) error {
+	_, err := strconv.Atoi(u.Config.Project)
+	byId := err == nil
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if (!byId || u.projectPath != "") && (u.Config.Branch != "" || u.defaultBranch != "") {
+		return nil
+	}
+	var project struct {
+		PathWithNamespace string `json:"path_with_namespace"`
+		DefaultBranch     string `json:"default_branch"`
+	}
+	if err := u.api.do(ctx, http.MethodGet, u.projectUrl(""), nil, 0, &project); err != nil {
+		return err
+	}
+	if u.Config.Branch == "" && project.DefaultBranch == "" {
+		return xretry.Fatal(errors.New("gitlab: project has no default branch, set branch"))
+	}
+	if byId {
+		u.projectPath = project.PathWithNamespace
+	}
+	u.defaultBranch = project.DefaultBranch
+	return nil
+}
+
+// branch returns the branch to commit to
+func (u *GitlabUploader) branch() string {
+	if u.Config.Branch != "" {
+		return u.Config.Branch
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.defaultBranch
+}
+
+// projectName returns path of the project, or its id if not looked up yet
+func (u *GitlabUploader) projectName() string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.projectPath != "" {
+		return u.projectPath
+	}
+	return strings.Trim(u.Config.Project, "/")
+}
+
+// projectUrl returns api url of the project followed by path. The project
+// path is a single url encoded segment, as GitLab takes it in place of the id.
+func (u *GitlabUploader) projectUrl(path string) string {
+	url := u.Config.baseUrl() + "/api/v4/projects/" + neturl.PathEscape(strings.Trim(u.Config.Project, "/"))
+	if path != "" {
+		url += "/" + path
+	}
+	return url
+}
+
+// fileUrl returns api url of the file at path, also a single encoded segment
+func (u *GitlabUploader) fileUrl(path string) string {
+	return u.projectUrl("repository/files/" + neturl.PathEscape(path))
+}
+
+// gitlabFile is the part of a repository file used by upgit
+type gitlabFile struct {
+	BlobID       string `json:"blob_id"`
+	LastCommitID string `json:"last_commit_id"`
+}
+
+// getFile returns the file at path on the branch, or nil if there is none
+func (u *GitlabUploader) getFile(ctx context.Context, path string) (*gitlabFile, error) {
+	var file gitlabFile
+	url := u.fileUrl(path) + "?ref=" + neturl.QueryEscape(u.branch())
+	err := u.api.do(ctx, http.MethodGet, url, nil, 0, &file)
+	var apiErr *apiError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+func (u *GitlabUploader) stat(ctx context.Context, path string) (string, error) {
+	if err := u.lookupProject(ctx); err != nil {
+		return "", err
+	}
+	file, err := u.getFile(ctx, path)
+	if file == nil {
+		return "", err
+	}
+	return file.BlobID, nil
+}
+
+// put creates a file with POST, or replaces one with PUT. GitLab doesn't tell
+// the commit made, which is looked up by lastCommit if needed.
+func (u *GitlabUploader) put(ctx context.Context, message, localPath, path, sha string) (string, error) {
+	method := http.MethodPost
+	if sha != "" {
+		method = http.MethodPut
+	}
+	return "", u.api.putFile(ctx, method, u.fileUrl(path), map[string]string{
+		"branch":         u.branch(),
+		"commit_message": message,
+		"encoding":       "base64",
+	}, localPath, nil)
+}
+
+func (u *GitlabUploader) lastCommit(ctx context.Context, path string) (string, error) {
+	file, err := u.getFile(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	if file == nil {
+		return "", errors.New(path + " not found after upload")
+	}
+	return file.LastCommitID, nil
+}
+
+func (u *GitlabUploader) rawUrl(path, commit string) string {
+	return forgeUrl(u.Config.urlFormat(),
+		"{base_url}", u.Config.baseUrl(),
+		"{project}", u.projectName(),
+		"{branch}", u.branch(),
+		"{commit}", commit,
+		"{path}", xhttp.EscapePath(path),
+	)
+}
@@ -2,7 +2,7 @@ package uploaders
 
 import (
 	"bytes"
-	"encoding/base64"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -19,14 +19,18 @@ import (
 	"github.com/pluveto/upgit/lib/model"
 	"github.com/pluveto/upgit/lib/result"
 	"github.com/pluveto/upgit/lib/xapp"
+	"github.com/pluveto/upgit/lib/xio"
 	"github.com/pluveto/upgit/lib/xlog"
 	"github.com/pluveto/upgit/lib/xmap"
+	"github.com/pluveto/upgit/lib/xprogress"
+	"github.com/pluveto/upgit/lib/xretry"
 	"github.com/pluveto/upgit/lib/xstrings"
 )
 
 type SimpleHttpUploader struct {
 	Config     map[string]interface{}
 	Definition map[string]interface{}
+	Options    xapp.UploaderOptions
 }
 
 // func (u SimpleHttpUploader) UploadAll(localPaths []string, targetDir string) {
@@ -78,124 +82,218 @@ func panicOnNilOrValue[T any](i interface{}, msg string) T {
 
 var ConfigDelimiters = []string{"$(", ")"}
 
-func (u SimpleHttpUploader) replaceStringPlaceholder(s string, task model.Task) string {
-	dict := make(map[string]interface{}, 1)
-	dict["_"] = s
-	u.replaceDictPlaceholder(dict, task)
-	xlog.GVerbose.Trace("replaceStringPlaceholder: %s => %s", s, dict["_"])
-	return dict["_"].(string)
+// replaceStringPlaceholder replaces placeholders in s.
+// It fails if any placeholder can't be resolved.
+func (u SimpleHttpUploader) replaceStringPlaceholder(s string, task model.Task) (string, error) {
+	var unresolved string
+	replacer := func(key string) *string {
+		var value interface{}
+		parentKey, subKey, found := strings.Cut(key, ".")
+		if found {
+			switch parentKey {
+			case "ext_config":
+				value = u.Config[subKey]
+			case "config":
+				value = GetValueByConfigTag(&xapp.AppCfg, subKey)
+			case "option":
+				value = GetValueByConfigTag(&xapp.AppOpt, subKey)
+			case "task":
+				value = GetValueByConfigTag(task, subKey)
+			}
+		}
+		if nil == value {
+			unresolved = key
+			return nil
+		}
+		ret := fmt.Sprint(value)
+		return &ret
+	}
+
+	ret := xstrings.VariableReplaceFunc(s, ConfigDelimiters[0], ConfigDelimiters[1], replacer)
+	if nil == ret {
+		return "", fmt.Errorf("unresolved placeholder %s%s%s", ConfigDelimiters[0], unresolved, ConfigDelimiters[1])
+	}
+	xlog.GVerbose.Trace("replaceStringPlaceholder: %s => %s", s, *ret)
+	return *ret, nil
 }
 
-func (u SimpleHttpUploader) replaceDictPlaceholder(data map[string]interface{}, task model.Task) {
+// replaceDictPlaceholder replaces placeholders in string values of data
+func (u SimpleHttpUploader) replaceDictPlaceholder(data map[string]interface{}, task model.Task) error {
 	for k, v_ := range data {
-		if reflect.TypeOf(v_).Kind() != reflect.String {
+		v, ok := v_.(string)
+		if !ok {
 			// xlog.GVerbose.Trace("skip non-string value: " + k)
 			continue
 		}
-		v := v_.(string)
-
-		replacer := func(key string) *string {
-			var ret string
-			parentKey, subKey, found := strings.Cut(key, ".")
-			if !found {
-				return nil
-			}
-			if parentKey == "ext_config" {
-				if v, ok := u.Config[subKey]; ok {
-					ret = v.(string)
-					return &ret
-				}
-			} else if parentKey == "config" {
-				ret = GetValueByConfigTag(&xapp.AppCfg, subKey).(string)
-				return &ret
-
-			} else if parentKey == "option" {
-				ret = GetValueByConfigTag(&xapp.AppOpt, subKey).(string)
-				return &ret
-
-			} else if parentKey == "task" {
-				ret = GetValueByConfigTag(task, subKey).(string)
-				return &ret
-			}
-			return nil
-		}
-
-		ret := xstrings.VariableReplaceFunc(v, ConfigDelimiters[0], ConfigDelimiters[1], replacer)
-		if nil != ret {
-			data[k] = *ret
+		ret, err := u.replaceStringPlaceholder(v, task)
+		if err != nil {
+			return fmt.Errorf("%s: %w", k, err)
 		}
+		data[k] = ret
 	}
+	return nil
 }
 
 func GetValueByConfigTag(data interface{}, key string) (ret interface{}) {
-	t := reflect.TypeOf(data)
+	v := reflect.Indirect(reflect.ValueOf(data))
+	t := v.Type()
 	n := t.NumField()
 	for i := 0; i < n; i++ {
 		f := t.Field(i)
-		if f.Tag.Get("json") == key || f.Tag.Get("yaml") == key || f.Tag.Get("toml") == key {
-			return reflect.ValueOf(data).Field(i).Interface()
+		tag := func(name string) string {
+			tagName, _, _ := strings.Cut(f.Tag.Get(name), ",")
+			return tagName
+		}
+		if tag("json") == key || tag("yaml") == key || tag("toml") == key {
+			return v.Field(i).Interface()
 		}
 	}
 	return nil
 }
 
-func (u SimpleHttpUploader) UploadFile(task *model.Task) (rawUrl string, err error) {
+// getDefinition reads value of key from extension definition
+func getDefinition[T any](def map[string]interface{}, key string) (ret T, err error) {
+	ret, err = xmap.GetDeep[T](def, key)
+	if err != nil {
+		err = fmt.Errorf("extension definition %s: %w", key, err)
+	}
+	return
+}
+
+func (u SimpleHttpUploader) UploadFile(ctx context.Context, task *model.Task) (rawUrl string, err error) {
+	req, err := u.buildRequest(ctx, task)
+	if err != nil {
+		return "", fmt.Errorf("prepare request: %w", err)
+	}
+
+	if req.Body != nil && req.Body != http.NoBody {
+		tracker := xprogress.Start(ctx, req.ContentLength)
+		defer func() { tracker.Finish(err) }()
+		req.Body = tracker.ReadCloser(req.Body)
+	}
+
+	// == Do Request ==
+	resp, err := u.Options.HTTPClient().Do(req)
+	if err != nil {
+		return "", fmt.Errorf("send request: %w", err)
+	}
+	defer resp.Body.Close()
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("read response: %w", err)
+	}
+	xlog.GVerbose.Info("response body:" + string(bodyBytes))
+	// check statuscode
+	if err = xretry.CheckResponse(resp, bodyBytes); err != nil {
+		return "", err
+	}
+
+	rawUrl, err = u.parseRawUrl(task, resp, bodyBytes)
+	if err != nil {
+		return "", fmt.Errorf("parse response: %w", err)
+	}
+	return
+}
+
+func (u SimpleHttpUploader) buildRequest(ctx context.Context, task *model.Task) (req *http.Request, err error) {
 	// == prepare method and url ==
-	method := result.From[string](xmap.GetDeep[string](u.Definition, "http.request.method")).ValueOrExit()
-	urlRaw := result.From[string](xmap.GetDeep[string](u.Definition, "http.request.url")).ValueOrExit()
+	method, err := getDefinition[string](u.Definition, "http.request.method")
+	if err != nil {
+		return
+	}
+	urlRaw, err := getDefinition[string](u.Definition, "http.request.url")
+	if err != nil {
+		return
+	}
 	params := result.From[map[string]interface{}](xmap.GetDeep[map[string]interface{}](u.Definition, "http.request.params")).ValueOrDefault(map[string]interface{}{})
-	u.replaceDictPlaceholder(params, *task)
-	url := result.From[*url.URL](url.Parse(u.replaceStringPlaceholder(urlRaw, *task))).ValueOrExit()
+	// definition is shared by concurrent tasks, never replace placeholders in place
+	params = xmap.DeepCopy(params)
+	if err = u.replaceDictPlaceholder(params, *task); err != nil {
+		return nil, fmt.Errorf("http.request.params: %w", err)
+	}
+	urlStr, err := u.replaceStringPlaceholder(urlRaw, *task)
+	if err != nil {
+		return nil, fmt.Errorf("http.request.url: %w", err)
+	}
+	url, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, fmt.Errorf("http.request.url: %w", err)
+	}
 	query := url.Query()
 	for paramName, paramValue := range params {
-		query.Add(paramName, paramValue.(string))
+		query.Add(paramName, fmt.Sprint(paramValue))
 	}
 	url.RawQuery = query.Encode()
 	xlog.GVerbose.Info("Method: %s, URL: %s", method, url.String())
 
 	//  == Prepare header ==
-	defHeaders := result.From[map[string]interface{}](xmap.GetDeep[map[string]interface{}](u.Definition, "http.request.headers")).ValueOrExit()
-	u.replaceDictPlaceholder(defHeaders, *task)
+	defHeaders, err := getDefinition[map[string]interface{}](u.Definition, "http.request.headers")
+	if err != nil {
+		return
+	}
+	defHeaders = xmap.DeepCopy(defHeaders)
+	if err = u.replaceDictPlaceholder(defHeaders, *task); err != nil {
+		return nil, fmt.Errorf("http.request.headers: %w", err)
+	}
 
-	xlog.GVerbose.Trace("unformatted headers:")
+	xlog.GVerbose.Trace("formatted headers:")
 	xlog.GVerbose.TraceStruct(defHeaders)
 	header := make(http.Header)
 	for k, v := range defHeaders {
-		header.Set(k, u.replaceStringPlaceholder(v.(string), *task))
+		header.Set(k, fmt.Sprint(v))
 	}
 	if header.Get("Content-Type") == "" {
 		header.Set("Content-Type", "application/octet-stream")
 	}
-	xlog.GVerbose.Trace("formatted headers:")
-	xlog.GVerbose.TraceStruct(map[string][]string(header))
 	// upload file according to content-type
 
 	// == Prepare body ==
+	// body is streamed from file, length is computed ahead since some servers
+	// don't accept chunked requests
 	var body io.ReadCloser
+	var length int64
 	switch header.Get("Content-Type") {
 	case "application/octet-stream":
-		body = ioutil.NopCloser(bytes.NewReader(result.From[[]byte](ioutil.ReadFile(task.LocalPath)).ValueOrExit()))
+		body, length, err = xio.OpenFile(task.LocalPath)
+		if err != nil {
+			return nil, err
+		}
 
 	case "multipart/form-data":
-		body = u.buildMultipartFormData(task, &header)
+		body, length, err = u.buildMultipartFormData(task, &header)
+		if err != nil {
+			return nil, fmt.Errorf("http.request.body: %w", err)
+		}
 	}
 
 	// == Create Request ==
-	req := result.From[*http.Request](http.NewRequest(method, u.replaceStringPlaceholder(url.String(), *task), body)).ValueOrExit()
+	req, err = http.NewRequestWithContext(ctx, method, url.String(), body)
+	if err != nil {
+		if body != nil {
+			body.Close()
+		}
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = length
+		if length == 0 {
+			// zero length with a body means unknown length to net/http
+			body.Close()
+			req.Body = http.NoBody
+		}
+	}
 	req.Header = header
 	xlog.GVerbose.Trace("do headers:")
 	xlog.GVerbose.TraceStruct(map[string][]string(req.Header))
+	return
+}
 
-	// == Do Request ==
-	resp := result.From[*http.Response](http.DefaultClient.Do(req)).ValueOrExit()
-	bodyBytes := result.From[[]byte](ioutil.ReadAll(resp.Body)).ValueOrExit()
-	xlog.GVerbose.Info("response body:" + string(bodyBytes))
-	// check statuscode
-	if !(200 <= resp.StatusCode && resp.StatusCode < 300) {
-		return "", fmt.Errorf("unexpected status code %d. response: %s", resp.StatusCode, string(bodyBytes))
+// parseRawUrl constructs rawUrl from response
+func (u SimpleHttpUploader) parseRawUrl(task *model.Task, resp *http.Response, bodyBytes []byte) (rawUrl string, err error) {
+	urlFrom, err := getDefinition[string](u.Definition, "upload.rawUrl.from")
+	if err != nil {
+		return
 	}
-	// == Construct rawUrl from Response ==
-	urlFrom := result.From[string](xmap.GetDeep[string](u.Definition, "upload.rawUrl.from")).ValueOrExit()
 	switch urlFrom {
 	case "json_response":
 		var respJson map[string]interface{}
@@ -203,10 +301,10 @@ func (u SimpleHttpUploader) UploadFile(task *model.Task) (rawUrl string, err err
 		if err != nil {
 			return "", errors.New("json response is not valid")
 		}
-		if !(200 <= resp.StatusCode && resp.StatusCode < 300) {
-			return "", fmt.Errorf("response status code %d is not expected. resp: %s", resp.StatusCode, string(bodyBytes))
+		rawUrlPath, err := getDefinition[string](u.Definition, "upload.rawUrl.path")
+		if err != nil {
+			return "", err
 		}
-		rawUrlPath := result.From[string](xmap.GetDeep[string](u.Definition, "upload.rawUrl.path")).ValueOrExit()
 		rawUrl, err = xmap.GetDeep[string](respJson, rawUrlPath)
 		if err != nil {
 			return "", errors.New("rawUrl path is not valid: " + err.Error())
@@ -220,57 +318,105 @@ func (u SimpleHttpUploader) UploadFile(task *model.Task) (rawUrl string, err err
 		rawUrl = string(bodyBytes)
 
 	case "template":
-		template := result.From[string](xmap.GetDeep[string](u.Definition, "upload.rawUrl.template")).ValueOrExit()
-		rawUrl = u.replaceStringPlaceholder(template, *task)
+		template, err := getDefinition[string](u.Definition, "upload.rawUrl.template")
+		if err != nil {
+			return "", err
+		}
+		rawUrl, err = u.replaceStringPlaceholder(template, *task)
+		if err != nil {
+			return "", fmt.Errorf("upload.rawUrl.template: %w", err)
+		}
 
 	case "response_header":
 
 		// read response header
-		key := result.From[string](xmap.GetDeep[string](u.Definition, "upload.rawUrl.header")).ValueOrExit()
+		key, err := getDefinition[string](u.Definition, "upload.rawUrl.header")
+		if err != nil {
+			return "", err
+		}
 		rawUrl = resp.Header.Get(key)
 
 	default:
-		return "", errors.New("unsupported rawUrl source" + urlFrom)
+		return "", errors.New("unsupported rawUrl source " + urlFrom)
 	}
 	return
 }
 
-func (u SimpleHttpUploader) buildMultipartFormData(task *model.Task, headerCache *http.Header) (body io.ReadCloser) {
+// buildMultipartFormData builds a multipart body streaming file content.
+// Part headers and string fields are written into buffers by a multipart
+// writer, file contents are read in between them while sending.
+func (u SimpleHttpUploader) buildMultipartFormData(task *model.Task, headerCache *http.Header) (body io.ReadCloser, length int64, err error) {
+	bodyTpl, err := getDefinition[map[string]interface{}](u.Definition, "http.request.body")
+	if err != nil {
+		return
+	}
+	var segments []io.Reader
+	defer func() {
+		if err != nil {
+			xio.MultiReadCloser(segments...).Close()
+		}
+	}()
 	var bodyBuff bytes.Buffer
 	mulWriter := multipart.NewWriter(&bodyBuff)
-	bodyTpl := result.From[map[string]interface{}](xmap.GetDeep[map[string]interface{}](u.Definition, "http.request.body")).ValueOrExit()
+	// flush moves content written by mulWriter so far into segments
+	flush := func() {
+		length += int64(bodyBuff.Len())
+		segments = append(segments, bytes.NewReader(append([]byte(nil), bodyBuff.Bytes()...)))
+		bodyBuff.Reset()
+	}
 	for fieldName, fieldMeta_ := range bodyTpl {
 		xlog.GVerbose.Trace("processing field: " + fieldName)
-		fieldMeta := fieldMeta_.(map[string]interface{})
+		fieldMeta, ok := fieldMeta_.(map[string]interface{})
+		if !ok {
+			return nil, 0, fmt.Errorf("field %s: definition is not an object", fieldName)
+		}
 		fieldType := fieldMeta["type"]
 
 		if fieldType == "string" {
-			fieldValue := u.replaceStringPlaceholder(fieldMeta["value"].(string), *task)
-			fieldValue = u.replaceStringPlaceholder(fieldValue, *task)
+			fieldValue, _ := fieldMeta["value"].(string)
+			fieldValue, err = u.replaceStringPlaceholder(fieldValue, *task)
+			if err != nil {
+				return nil, 0, fmt.Errorf("field %s: %w", fieldName, err)
+			}
 			mulWriter.WriteField(fieldName, fieldValue)
 			xlog.GVerbose.Trace("field(string) value: " + fieldValue)
 
-		} else if fieldType == "file" {
+		} else if fieldType == "file" || fieldType == "file_base64" {
 			fileName := filepath.Base(task.LocalPath)
-			part := result.From[io.Writer](mulWriter.CreateFormFile(fieldName, fileName)).ValueOrExit()
-			n, err := part.Write(result.From[[]byte](ioutil.ReadFile(task.LocalPath)).ValueOrExit())
-			xlog.AbortErr(err)
-			xlog.GVerbose.Trace("field(file) value: "+"[file (len=%d, name=%s)]", n, fileName)
-
-		} else if fieldType == "file_base64" {
-			dat, err := ioutil.ReadFile(task.LocalPath)
-			xlog.AbortErr(err)
-			encoded := base64.StdEncoding.EncodeToString(dat)
-			mulWriter.WriteField(fieldName, encoded)
+			if fieldType == "file" {
+				_, err = mulWriter.CreateFormFile(fieldName, fileName)
+			} else {
+				_, err = mulWriter.CreateFormField(fieldName)
+			}
+			if err != nil {
+				return nil, 0, fmt.Errorf("field %s: %w", fieldName, err)
+			}
+			flush()
+			file, size, err := xio.OpenFile(task.LocalPath)
+			if err != nil {
+				return nil, 0, err
+			}
+			if fieldType == "file" {
+				segments = append(segments, file)
+				length += size
+			} else {
+				segments = append(segments, xio.Base64Reader(file))
+				length += xio.Base64Len(size)
+			}
+			xlog.GVerbose.Trace("field(%s) value: [file (len=%d, name=%s)]", fieldType, size, fileName)
 		}
 	}
 	headerCache.Set("Content-Type", mulWriter.FormDataContentType())
 	mulWriter.Close()
-	body = ioutil.NopCloser(bytes.NewReader(bodyBuff.Bytes()))
-	return
+	flush()
+	return xio.MultiReadCloser(segments...), length, nil
+}
+
+func (u SimpleHttpUploader) Upload(t *model.Task) error {
+	return u.UploadContext(context.Background(), t)
 }
 
-func (u SimpleHttpUploader) Upload(t *model.Task) (err error) {
+func (u SimpleHttpUploader) UploadContext(ctx context.Context, t *model.Task) (err error) {
 	now := time.Now()
 	base := filepath.Base(t.LocalPath)
 
@@ -281,11 +427,14 @@ func (u SimpleHttpUploader) Upload(t *model.Task) (err error) {
 		t.TargetDir = filepath.Dir(t.TargetPath)
 	}
 	xlog.GVerbose.Trace("uploading #TASK_%d %s\n", t.TaskId, t.LocalPath)
-	// var err error
-	rawUrl, err := u.UploadFile(t)
+	var rawUrl string
+	t.Attempts, err = xretry.Do(ctx, u.Options.Retry, func() (err error) {
+		rawUrl, err = u.UploadFile(ctx, t)
+		return
+	})
 	var url string
 	if err == nil {
-		url := xapp.ReplaceUrl(rawUrl)
+		url = xapp.ReplaceUrl(rawUrl)
 		xlog.GVerbose.Trace("sucessfully uploaded #TASK_%d %s => %s\n", t.TaskId, t.LocalPath, url)
 		t.Status = model.TASK_FINISHED
 	} else {
@@ -0,0 +1,194 @@
+package upyun
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pluveto/upgit/lib/xapp"
+	"github.com/pluveto/upgit/lib/xhttp"
+	"github.com/pluveto/upgit/lib/xlog"
+	"github.com/pluveto/upgit/lib/xretry"
+)
+
+// DefaultApiHost picks the best line automatically
+const DefaultApiHost = "v0.api.upyun.com"
+
+// listEnd is the x-upyun-list-iter value marking the last page of a listing
+const listEnd = "g2gCZAAEbmV4dGQAA2VvZg"
+
+// Client talks to the Upyun REST API.
+// See https://help.upyun.com/knowledge-base/rest_api/
+type Client struct {
+	Bucket   string
+	Operator string
+	// ApiHost is one of v0 (auto), v1 (telecom), v2 (unicom) or v3 (mobile).api.upyun.com
+	ApiHost    string
+	HTTPClient *http.Client
+
+	// passwordMd5 is the hex md5 of operator password, used as the signing key
+	passwordMd5 string
+}
+
+func NewClient(bucket, operator, password string) *Client {
+	sum := md5.Sum([]byte(password))
+	return &Client{
+		Bucket:      bucket,
+		Operator:    operator,
+		ApiHost:     DefaultApiHost,
+		HTTPClient:  http.DefaultClient,
+		passwordMd5: hex.EncodeToString(sum[:]),
+	}
+}
+
+// FileInfo is an entry of a directory listing
+type FileInfo struct {
+	Name string `json:"name"`
+	// Type is "folder" for directories, otherwise mime type of file
+	Type         string `json:"type"`
+	Length       int64  `json:"length"`
+	LastModified int64  `json:"last_modified"`
+}
+
+func (f FileInfo) IsDir() bool {
+	return f.Type == "folder" || f.Type == "F"
+}
+
+// sign makes the Authorization header:
+// UPYUN operator:base64(hmac-sha1(md5(password), method&uri&date[&content-md5]))
+func (c *Client) sign(method, uri, date, contentMd5 string) string {
+	parts := []string{method, uri, date}
+	if contentMd5 != "" {
+		parts = append(parts, contentMd5)
+	}
+	h := hmac.New(sha1.New, []byte(c.passwordMd5))
+	h.Write([]byte(strings.Join(parts, "&")))
+	return "UPYUN " + c.Operator + ":" + base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// do sends a signed request for path in bucket and returns the response if
+// it succeeded. Caller should close the response body.
+func (c *Client) do(ctx context.Context, method, path, query string, header http.Header, body io.Reader, length int64) (*http.Response, error) {
+	uri := "/" + c.Bucket + "/" + xhttp.EscapePath(strings.TrimPrefix(path, "/"))
+	url := c.ApiHost + uri
+	if !strings.Contains(c.ApiHost, "://") {
+		url = "https://" + url
+	}
+	if query != "" {
+		url += "?" + query
+	}
+	xlog.GVerbose.Trace("%s %s", method, url)
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.ContentLength = length
+	}
+	date := time.Now().UTC().Format(http.TimeFormat)
+	req.Header.Set("Date", date)
+	req.Header.Set("Authorization", c.sign(method, uri, date, req.Header.Get("Content-MD5")))
+	req.Header.Set("User-Agent", xapp.UserAgent)
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if 200 <= resp.StatusCode && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	xlog.GVerbose.Trace("response body: " + string(respBody))
+	var ret struct {
+		Msg  string `json:"msg"`
+		Code int    `json:"code"`
+	}
+	msg := resp.Status
+	if json.Unmarshal(respBody, &ret) == nil && ret.Msg != "" {
+		msg = fmt.Sprintf("%s (%d)", ret.Msg, ret.Code)
+	}
+	return nil, xretry.ClassifyStatus(resp.StatusCode, resp.Header, respBody, errors.New("upyun: "+msg))
+}
+
+// Put uploads body of given length to path. Missing parent directories are
+// created by Upyun. Header may carry Content-Type, Content-MD5,
+// Content-Secret and x-upyun-meta-*.
+func (c *Client) Put(ctx context.Context, path string, body io.Reader, length int64, header http.Header) error {
+	resp, err := c.do(ctx, http.MethodPut, path, "", header, body, length)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Delete removes a file or an empty directory
+func (c *Client) Delete(ctx context.Context, path string) error {
+	resp, err := c.do(ctx, http.MethodDelete, path, "", nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// List returns entries of directory dir, following pagination
+func (c *Client) List(ctx context.Context, dir string) ([]FileInfo, error) {
+	var ret []FileInfo
+	iter := ""
+	for {
+		header := http.Header{}
+		header.Set("Accept", "application/json")
+		header.Set("x-list-limit", "1000")
+		if iter != "" {
+			header.Set("x-list-iter", iter)
+		}
+		resp, err := c.do(ctx, http.MethodGet, dir, "", header, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Files []FileInfo `json:"files"`
+			Iter  string     `json:"iter"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, page.Files...)
+		if page.Iter == "" || page.Iter == listEnd || len(page.Files) == 0 {
+			return ret, nil
+		}
+		iter = page.Iter
+	}
+}
+
+// Usage returns bytes used by the bucket
+func (c *Client) Usage(ctx context.Context) (int64, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/", "usage", nil, nil, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(buf)), 10, 64)
+}
@@ -1,14 +1,22 @@
 package upyun
 
 import (
-	"os"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"net/http"
 	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/pluveto/upgit/lib/model"
 	"github.com/pluveto/upgit/lib/xapp"
+	"github.com/pluveto/upgit/lib/xhttp"
+	"github.com/pluveto/upgit/lib/xio"
 	"github.com/pluveto/upgit/lib/xlog"
+	"github.com/pluveto/upgit/lib/xprogress"
+	"github.com/pluveto/upgit/lib/xretry"
 )
 
 type UpyunConfig struct {
@@ -16,15 +24,27 @@ type UpyunConfig struct {
 	BucketName string `toml:"bucket_name" mapstructure:"bucket_name" validate:"nonzero"`
 	UserName   string `toml:"user_name" mapstructure:"user_name" validate:"nonzero"`
 	PassWord   string `toml:"pass_word" mapstructure:"pass_word" validate:"nonzero"`
+	// ApiHost selects the line of REST API, v0.api.upyun.com by default
+	ApiHost string `toml:"api_host,omitempty" mapstructure:"api_host"`
+	// ContentMD5 lets Upyun verify the uploaded file, at the cost of reading it twice
+	ContentMD5 bool `toml:"content_md5,omitempty" mapstructure:"content_md5"`
+	// ContentSecret protects images from being accessed without it. The url
+	// becomes https://{host}/{path}!{secret}
+	ContentSecret string `toml:"content_secret,omitempty" mapstructure:"content_secret"`
 }
 
 type UpyunUploader struct {
-	Config UpyunConfig
+	Config  UpyunConfig
+	Options xapp.UploaderOptions
 }
 
 var urlfmt = "https://{host}/{path}"
 
 func (u UpyunUploader) Upload(t *model.Task) error {
+	return u.UploadContext(context.Background(), t)
+}
+
+func (u UpyunUploader) UploadContext(ctx context.Context, t *model.Task) error {
 	now := time.Now()
 	name := filepath.Base(t.LocalPath)
 	var targetPath string
@@ -36,8 +56,10 @@ func (u UpyunUploader) Upload(t *model.Task) error {
 	rawUrl := u.buildUrl(urlfmt, targetPath)
 	url := xapp.ReplaceUrl(rawUrl)
 	xlog.GVerbose.Info("uploading #TASK_%d %s\n", t.TaskId, t.LocalPath)
-	// var err error
-	err := u.PutFile(t.LocalPath, targetPath)
+	attempts, err := xretry.Do(ctx, u.Options.Retry, func() error {
+		return u.PutFile(ctx, t.LocalPath, targetPath)
+	})
+	t.Attempts = attempts
 	if err == nil {
 		xlog.GVerbose.Info("sucessfully uploaded #TASK_%d %s => %s\n", t.TaskId, t.LocalPath, url)
 		t.Status = model.TASK_FINISHED
@@ -55,17 +77,55 @@ func (u UpyunUploader) Upload(t *model.Task) error {
 func (u *UpyunUploader) buildUrl(urlfmt, path string) string {
 	r := strings.NewReplacer(
 		"{host}", u.Config.Host,
-		"{path}", path,
+		"{path}", xhttp.EscapePath(path),
 	)
-	return r.Replace(urlfmt)
+	url := r.Replace(urlfmt)
+	if u.Config.ContentSecret != "" {
+		url += "!" + u.Config.ContentSecret
+	}
+	return url
+}
+
+// Client returns the REST API client of configured bucket
+func (u *UpyunUploader) Client() *Client {
+	c := NewClient(u.Config.BucketName, u.Config.UserName, u.Config.PassWord)
+	c.HTTPClient = u.Options.HTTPClient()
+	if u.Config.ApiHost != "" {
+		c.ApiHost = u.Config.ApiHost
+	}
+	return c
 }
 
-func (u *UpyunUploader) PutFile(localPath, targetPath string) (err error) {
-	upyun := NewUpYun(u.Config.BucketName, u.Config.UserName, u.Config.PassWord)
-	file, err := os.OpenFile(localPath, os.O_RDONLY, 0644)
+func (u *UpyunUploader) PutFile(ctx context.Context, localPath, targetPath string) (err error) {
+	file, size, err := xio.OpenFile(localPath)
 	if err != nil {
 		return err
 	}
-	err = upyun.WriteFile(targetPath, file, true)
-	return
+	defer file.Close()
+	meta := u.Options.Metadata.Resolve(localPath)
+	header := http.Header{}
+	header.Set("Content-Type", meta.ContentType)
+	if meta.ContentDisposition != "" {
+		header.Set("Content-Disposition", meta.ContentDisposition)
+	}
+	for k, v := range meta.Meta {
+		header.Set("x-upyun-meta-"+k, v)
+	}
+	if u.Config.ContentSecret != "" {
+		header.Set("Content-Secret", u.Config.ContentSecret)
+	}
+	if u.Config.ContentMD5 {
+		h := md5.New()
+		if _, err := io.Copy(h, file); err != nil {
+			return err
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		header.Set("Content-MD5", hex.EncodeToString(h.Sum(nil)))
+	}
+
+	tracker := xprogress.Start(ctx, size)
+	defer func() { tracker.Finish(err) }()
+	return u.Client().Put(ctx, targetPath, tracker.Reader(file), size, header)
 }
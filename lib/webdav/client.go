@@ -0,0 +1,340 @@
+package webdav
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/pluveto/upgit/lib/xapp"
+	"github.com/pluveto/upgit/lib/xhttp"
+	"github.com/pluveto/upgit/lib/xlog"
+	"github.com/pluveto/upgit/lib/xretry"
+)
+
+// Authentication schemes
+const (
+	AuthBasic  = "basic"
+	AuthDigest = "digest"
+	AuthBearer = "bearer"
+)
+
+// Client talks to a WebDAV server under Endpoint
+type Client struct {
+	// Endpoint is the url of the root collection, like
+	// https://cloud.example.com/remote.php/dav/files/me
+	Endpoint   string
+	Auth       string
+	Username   string
+	Password   string
+	Token      string
+	HTTPClient *http.Client
+
+	mu sync.Mutex
+	// challenge is the last digest challenge of the server
+	challenge *digestChallenge
+	// nc counts requests made with the nonce of challenge
+	nc int
+	// collections are the ones known to exist
+	collections map[string]bool
+}
+
+func NewClient(endpoint string) *Client {
+	return &Client{
+		Endpoint:    strings.TrimSuffix(endpoint, "/"),
+		HTTPClient:  http.DefaultClient,
+		collections: make(map[string]bool),
+	}
+}
+
+// Url returns url of path under the endpoint
+func (c *Client) Url(path string) string {
+	return c.Endpoint + "/" + xhttp.EscapePath(strings.TrimPrefix(path, "/"))
+}
+
+// Do sends an authorized request and returns the response if it succeeded.
+// Caller should close the response body. A request rejected with a new
+// digest challenge is retryable, as its body can't be sent again here.
+func (c *Client) Do(ctx context.Context, method, url string, header http.Header, body io.Reader, length int64) (*http.Response, error) {
+	xlog.GVerbose.Trace("%s %s", method, url)
+	if c.Auth == AuthDigest {
+		if err := c.fetchChallenge(ctx); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.ContentLength = length
+	}
+	req.Header.Set("User-Agent", xapp.UserAgent)
+	c.authorize(req)
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if 200 <= resp.StatusCode && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	xlog.GVerbose.Trace("response body: " + string(respBody))
+	err = &StatusError{StatusCode: resp.StatusCode, Err: fmt.Errorf("webdav: %s %s: %s", method, url, resp.Status)}
+	if resp.StatusCode == http.StatusUnauthorized && c.Auth == AuthDigest {
+		if ch := findChallenge(resp.Header); ch != nil && ch.Stale {
+			c.setChallenge(ch)
+			return nil, xretry.Retryable(err, 0)
+		}
+	}
+	return nil, xretry.ClassifyStatus(resp.StatusCode, resp.Header, respBody, err)
+}
+
+// StatusError keeps status code of a failed request
+type StatusError struct {
+	StatusCode int
+	Err        error
+}
+
+func (e *StatusError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *StatusError) Unwrap() error {
+	return e.Err
+}
+
+// StatusCode returns status code of the response causing err, or 0
+func StatusCode(err error) int {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode
+	}
+	return 0
+}
+
+// MkcolAll creates collection dir and its missing parents. Collections seen
+// before are not requested again.
+func (c *Client) MkcolAll(ctx context.Context, dir string) error {
+	dir = strings.Trim(dir, "/")
+	if dir == "" || dir == "." {
+		return nil
+	}
+	parts := strings.Split(dir, "/")
+	for i := range parts {
+		col := strings.Join(parts[:i+1], "/")
+		c.mu.Lock()
+		known := c.collections[col]
+		c.mu.Unlock()
+		if known {
+			continue
+		}
+		resp, err := c.Do(ctx, "MKCOL", c.Url(col)+"/", nil, nil, 0)
+		// 405 tells the collection exists
+		if err != nil && StatusCode(err) != http.StatusMethodNotAllowed {
+			return err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		c.mu.Lock()
+		c.collections[col] = true
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+// Put uploads body of given length to path, replacing any file there
+func (c *Client) Put(ctx context.Context, path string, body io.Reader, length int64, header http.Header) error {
+	resp, err := c.Do(ctx, http.MethodPut, c.Url(path), header, body, length)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *Client) authorize(req *http.Request) {
+	switch c.Auth {
+	case AuthBearer:
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	case AuthDigest:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.challenge != nil {
+			c.nc++
+			req.Header.Set("Authorization", c.challenge.authorization(c.Username, c.Password, req.Method, req.URL.RequestURI(), c.nc))
+		}
+	default:
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+}
+
+// fetchChallenge gets a digest challenge by an unauthorized PROPFIND of the
+// endpoint before the first request, so that bodies are sent only once
+func (c *Client) fetchChallenge(ctx context.Context) error {
+	c.mu.Lock()
+	known := c.challenge != nil
+	c.mu.Unlock()
+	if known {
+		return nil
+	}
+	url := c.Endpoint + "/"
+	req, err := http.NewRequestWithContext(ctx, "PROPFIND", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Depth", "0")
+	req.Header.Set("User-Agent", xapp.UserAgent)
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	ch := findChallenge(resp.Header)
+	if ch == nil {
+		return xretry.Fatal(fmt.Errorf("webdav: %s didn't ask for digest auth", url))
+	}
+	c.setChallenge(ch)
+	return nil
+}
+
+func (c *Client) setChallenge(ch *digestChallenge) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.challenge = ch
+	c.nc = 0
+}
+
+// digestChallenge is a WWW-Authenticate: Digest header of RFC 7616
+type digestChallenge struct {
+	Realm     string
+	Nonce     string
+	Opaque    string
+	Algorithm string
+	// Qop is "auth" if the server offers it, otherwise the legacy RFC 2069
+	// response is made
+	Qop   string
+	Stale bool
+}
+
+// findChallenge returns the first digest challenge of WWW-Authenticate
+// headers, which servers offering several schemes send one per scheme, or
+// nil if there is none
+func findChallenge(header http.Header) *digestChallenge {
+	for _, v := range header.Values("WWW-Authenticate") {
+		if ch := parseChallenge(v); ch != nil {
+			return ch
+		}
+	}
+	return nil
+}
+
+// parseChallenge parses a digest challenge, or returns nil if header isn't one
+func parseChallenge(header string) *digestChallenge {
+	scheme, params, ok := strings.Cut(strings.TrimSpace(header), " ")
+	if !ok || !strings.EqualFold(scheme, "Digest") {
+		return nil
+	}
+	ch := &digestChallenge{Algorithm: "MD5"}
+	for _, param := range splitParams(params) {
+		k, v, _ := strings.Cut(param, "=")
+		v = strings.Trim(strings.TrimSpace(v), `"`)
+		switch strings.ToLower(strings.TrimSpace(k)) {
+		case "realm":
+			ch.Realm = v
+		case "nonce":
+			ch.Nonce = v
+		case "opaque":
+			ch.Opaque = v
+		case "algorithm":
+			ch.Algorithm = v
+		case "stale":
+			ch.Stale = strings.EqualFold(v, "true")
+		case "qop":
+			for _, q := range strings.Split(v, ",") {
+				if strings.TrimSpace(q) == "auth" {
+					ch.Qop = "auth"
+				}
+			}
+		}
+	}
+	return ch
+}
+
+// splitParams splits comma separated params, keeping commas in quotes
+func splitParams(s string) []string {
+	var ret []string
+	quoted := false
+	start := 0
+	for i, r := range s {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == ',' && !quoted:
+			ret = append(ret, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(ret, s[start:])
+}
+
+// authorization makes the Authorization header of a request
+func (ch *digestChallenge) authorization(username, password, method, uri string, nc int) string {
+	algorithm := strings.ToUpper(ch.Algorithm)
+	newHash := md5.New
+	if strings.HasPrefix(algorithm, "SHA-256") {
+		newHash = sha256.New
+	}
+	digest := func(s string) string {
+		h := newHash()
+		h.Write([]byte(s))
+		return hex.EncodeToString(h.Sum(nil))
+	}
+	cnonce := randomHex(8)
+	ha1 := digest(username + ":" + ch.Realm + ":" + password)
+	if strings.HasSuffix(algorithm, "-SESS") {
+		ha1 = digest(ha1 + ":" + ch.Nonce + ":" + cnonce)
+	}
+	ha2 := digest(method + ":" + uri)
+	ncValue := fmt.Sprintf("%08x", nc)
+	var response string
+	if ch.Qop == "" {
+		response = digest(ha1 + ":" + ch.Nonce + ":" + ha2)
+	} else {
+		response = digest(ha1 + ":" + ch.Nonce + ":" + ncValue + ":" + cnonce + ":" + ch.Qop + ":" + ha2)
+	}
+	params := []string{
+		fmt.Sprintf(`username="%s"`, username),
+		fmt.Sprintf(`realm="%s"`, ch.Realm),
+		fmt.Sprintf(`nonce="%s"`, ch.Nonce),
+		fmt.Sprintf(`uri="%s"`, uri),
+		"algorithm=" + ch.Algorithm,
+		fmt.Sprintf(`response="%s"`, response),
+	}
+	if ch.Opaque != "" {
+		params = append(params, fmt.Sprintf(`opaque="%s"`, ch.Opaque))
+	}
+	if ch.Qop != "" {
+		params = append(params, "qop="+ch.Qop, "nc="+ncValue, fmt.Sprintf(`cnonce="%s"`, cnonce))
+	}
+	return "Digest " + strings.Join(params, ", ")
+}
+
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,235 @@
+package webdav
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	neturl "net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pluveto/upgit/lib/model"
+	"github.com/pluveto/upgit/lib/xapp"
+	"github.com/pluveto/upgit/lib/xhttp"
+	"github.com/pluveto/upgit/lib/xio"
+	"github.com/pluveto/upgit/lib/xlog"
+	"github.com/pluveto/upgit/lib/xprogress"
+	"github.com/pluveto/upgit/lib/xretry"
+)
+
+type WebdavConfig struct {
+	// Endpoint is the url of the collection to upload into, like
+	// https://cloud.example.com/remote.php/dav/files/me/upgit
+	Endpoint string `toml:"endpoint" mapstructure:"endpoint" validate:"nonzero"`
+	// Auth is AuthBasic, AuthDigest or AuthBearer. It defaults to bearer if
+	// token is set, otherwise to basic.
+	Auth     string `toml:"auth,omitempty" mapstructure:"auth"`
+	Username string `toml:"username,omitempty" mapstructure:"username"`
+	Password string `toml:"password,omitempty" mapstructure:"password"`
+	Token    string `toml:"token,omitempty" mapstructure:"token"`
+	// UrlFormat is the format of file urls, in which {endpoint} and {path}
+	// are replaced. kUrlFmt if not set.
+	UrlFormat string `toml:"url_format,omitempty" mapstructure:"url_format"`
+	// Share creates a public link of each file through the OCS API of
+	// Nextcloud or ownCloud and outputs it instead of UrlFormat
+	Share bool `toml:"share,omitempty" mapstructure:"share"`
+	// ShareDownload appends /download to share links, so that they serve
+	// the file itself instead of a preview page
+	ShareDownload bool `toml:"share_download,omitempty" mapstructure:"share_download"`
+}
+
+const kUrlFmt = "{endpoint}/{path}"
+
+// auth returns the authentication scheme in effect
+func (c WebdavConfig) auth() string {
+	if c.Auth != "" {
+		return strings.ToLower(c.Auth)
+	}
+	if c.Token != "" {
+		return AuthBearer
+	}
+	return AuthBasic
+}
+
+// Validate checks fields not covered by validator tags
+func (c WebdavConfig) Validate() error {
+	if _, err := neturl.Parse(c.Endpoint); err != nil {
+		return errors.New("webdav: " + err.Error())
+	}
+	switch c.auth() {
+	case AuthBasic, AuthDigest:
+		if c.Username == "" {
+			return errors.New("webdav: username is required by " + c.auth() + " auth")
+		}
+	case AuthBearer:
+		if c.Token == "" {
+			return errors.New("webdav: token is required by bearer auth")
+		}
+	default:
+		return errors.New("webdav: unknown auth " + c.Auth)
+	}
+	if c.Share {
+		if _, _, ok := c.shareRoot(); !ok {
+			return errors.New("webdav: share needs an endpoint like <server>/remote.php/dav/files/<user> or <server>/remote.php/webdav")
+		}
+	}
+	return nil
+}
+
+// shareRoot splits a Nextcloud or ownCloud endpoint into the server url and
+// the path of the endpoint in files of the user
+func (c WebdavConfig) shareRoot() (server, dir string, ok bool) {
+	server, rest, ok := strings.Cut(strings.TrimSuffix(c.Endpoint, "/"), "/remote.php/")
+	if !ok {
+		return "", "", false
+	}
+	switch {
+	case rest == "webdav" || strings.HasPrefix(rest, "webdav/"):
+		dir = strings.TrimPrefix(rest, "webdav")
+	case strings.HasPrefix(rest, "dav/files/"):
+		// dav/files/<user>/<dir>
+		parts := strings.SplitN(strings.TrimPrefix(rest, "dav/files/"), "/", 2)
+		if len(parts) == 2 {
+			dir = parts[1]
+		}
+	default:
+		return "", "", false
+	}
+	dir, err := neturl.PathUnescape(dir)
+	if err != nil {
+		return "", "", false
+	}
+	return server, "/" + strings.Trim(dir, "/"), true
+}
+
+type WebdavUploader struct {
+	Config  WebdavConfig
+	Options xapp.UploaderOptions
+
+	client *Client
+}
+
+func NewWebdavUploader(cfg WebdavConfig, opts xapp.UploaderOptions) *WebdavUploader {
+	c := NewClient(cfg.Endpoint)
+	c.Auth = cfg.auth()
+	c.Username = cfg.Username
+	c.Password = cfg.Password
+	c.Token = cfg.Token
+	c.HTTPClient = opts.HTTPClient()
+	return &WebdavUploader{Config: cfg, Options: opts, client: c}
+}
+
+func (u *WebdavUploader) Upload(t *model.Task) error {
+	return u.UploadContext(context.Background(), t)
+}
+
+func (u *WebdavUploader) UploadContext(ctx context.Context, t *model.Task) error {
+	now := time.Now()
+	name := filepath.Base(t.LocalPath)
+	var targetPath string
+	if len(t.TargetDir) > 0 {
+		targetPath = t.TargetDir + "/" + name
+	} else {
+		targetPath = xapp.Rename(name, now)
+	}
+	rawUrl := u.buildUrl(targetPath)
+	xlog.GVerbose.Info("uploading #TASK_%d %s\n", t.TaskId, t.LocalPath)
+	uploaded := false
+	attempts, err := xretry.Do(ctx, u.Options.Retry, func() (err error) {
+		if !uploaded {
+			if err := u.client.MkcolAll(ctx, path.Dir(targetPath)); err != nil {
+				return err
+			}
+			if err := u.PutFile(ctx, t.LocalPath, targetPath); err != nil {
+				return err
+			}
+			uploaded = true
+		}
+		if u.Config.Share {
+			rawUrl, err = u.share(ctx, targetPath)
+		}
+		return err
+	})
+	t.Attempts = attempts
+	url := xapp.ReplaceUrl(rawUrl)
+	if err == nil {
+		xlog.GVerbose.Info("sucessfully uploaded #TASK_%d %s => %s\n", t.TaskId, t.LocalPath, url)
+		t.Status = model.TASK_FINISHED
+		t.Url = url
+		t.FinishTime = time.Now()
+		t.RawUrl = rawUrl
+	} else {
+		xlog.GVerbose.Info("failed to upload #TASK_%d %s : %s\n", t.TaskId, t.LocalPath, err.Error())
+		t.Status = model.TASK_FAILED
+		t.FinishTime = time.Now()
+	}
+	return err
+}
+
+func (u *WebdavUploader) buildUrl(targetPath string) string {
+	urlfmt := u.Config.UrlFormat
+	if urlfmt == "" {
+		urlfmt = kUrlFmt
+	}
+	return strings.NewReplacer(
+		"{endpoint}", strings.TrimSuffix(u.Config.Endpoint, "/"),
+		"{path}", xhttp.EscapePath(targetPath),
+	).Replace(urlfmt)
+}
+
+func (u *WebdavUploader) PutFile(ctx context.Context, localPath, targetPath string) (err error) {
+	file, size, err := xio.OpenFile(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	header := http.Header{}
+	header.Set("Content-Type", u.Options.Metadata.Resolve(localPath).ContentType)
+	tracker := xprogress.Start(ctx, size)
+	defer func() { tracker.Finish(err) }()
+	return u.client.Put(ctx, targetPath, tracker.Reader(file), size, header)
+}
+
+// share creates a read-only public link of the file at targetPath and
+// returns its url
+func (u *WebdavUploader) share(ctx context.Context, targetPath string) (string, error) {
+	server, dir, _ := u.Config.shareRoot()
+	form := neturl.Values{
+		"path":        {path.Join(dir, targetPath)},
+		"shareType":   {"3"},
+		"permissions": {"1"},
+	}.Encode()
+	header := http.Header{}
+	header.Set("OCS-APIRequest", "true")
+	header.Set("Accept", "application/json")
+	header.Set("Content-Type", "application/x-www-form-urlencoded")
+	url := server + "/ocs/v2.php/apps/files_sharing/api/v1/shares?format=json"
+	resp, err := u.client.Do(ctx, http.MethodPost, url, header, strings.NewReader(form), int64(len(form)))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var ret struct {
+		Ocs struct {
+			Meta struct {
+				Message string `json:"message"`
+			} `json:"meta"`
+			Data struct {
+				URL string `json:"url"`
+			} `json:"data"`
+		} `json:"ocs"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&ret); err != nil {
+		return "", err
+	}
+	if ret.Ocs.Data.URL == "" {
+		return "", xretry.Fatal(errors.New("webdav: no share link returned: " + ret.Ocs.Meta.Message))
+	}
+	if u.Config.ShareDownload {
+		return ret.Ocs.Data.URL + "/download", nil
+	}
+	return ret.Ocs.Data.URL, nil
+}
@@ -0,0 +1,188 @@
+package webdav
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pluveto/upgit/lib/model"
+	"github.com/pluveto/upgit/lib/xapp"
+)
+
+// fakeDav is a WebDAV server asking for digest auth, or basic auth if
+// basic is set, with the sharing API of Nextcloud
+type fakeDav struct {
+	basic bool
+	// offerBasic makes the server offer basic auth before digest auth, in
+	// its own WWW-Authenticate header
+	offerBasic bool
+	mu         sync.Mutex
+	// cols and files hold paths under /remote.php/dav/files/me
+	cols     map[string]bool
+	files    map[string]string
+	requests []string
+	// shared is the path of the last share created
+	shared string
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func (f *fakeDav) authorized(r *http.Request) bool {
+	if f.basic {
+		user, pass, ok := r.BasicAuth()
+		return ok && user == "me" && pass == "secret"
+	}
+	params := make(map[string]string)
+	for _, p := range splitParams(strings.TrimPrefix(r.Header.Get("Authorization"), "Digest ")) {
+		k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+		params[k] = strings.Trim(v, `"`)
+	}
+	ha1 := md5Hex("me:dav:secret")
+	ha2 := md5Hex(r.Method + ":" + params["uri"])
+	want := md5Hex(ha1 + ":n0:" + params["nc"] + ":" + params["cnonce"] + ":auth:" + ha2)
+	return params["uri"] == r.URL.RequestURI() && params["response"] == want
+}
+
+func (f *fakeDav) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.authorized(r) {
+		if f.offerBasic {
+			w.Header().Add("WWW-Authenticate", `Basic realm="dav"`)
+		}
+		w.Header().Add("WWW-Authenticate", `Digest realm="dav", nonce="n0", qop="auth,auth-int", algorithm=MD5`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	if r.URL.Path == "/ocs/v2.php/apps/files_sharing/api/v1/shares" {
+		if r.Header.Get("OCS-APIRequest") != "true" || r.FormValue("shareType") != "3" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.shared = r.FormValue("path")
+		fmt.Fprint(w, `{"ocs":{"meta":{"status":"ok"},"data":{"url":"https://cloud.example.com/s/abc"}}}`)
+		return
+	}
+	p, ok := strings.CutPrefix(r.URL.Path, "/remote.php/dav/files/me/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	p = strings.TrimSuffix(p, "/")
+	parent := filepath.Dir(p)
+	switch r.Method {
+	case "MKCOL":
+		if f.cols[p] {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if parent != "." && !f.cols[parent] {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		f.cols[p] = true
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodPut:
+		if parent != "." && !f.cols[parent] {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		buf, _ := io.ReadAll(r.Body)
+		f.files[p] = string(buf)
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestWebdavUploader(t *testing.T) {
+	dav := &fakeDav{cols: map[string]bool{"up": true}, files: make(map[string]string)}
+	server := httptest.NewServer(dav)
+	defer server.Close()
+	local := filepath.Join(t.TempDir(), "a b.png")
+	if err := os.WriteFile(local, []byte("png"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	upload := func(cfg WebdavConfig, dir string) *model.Task {
+		if err := cfg.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		task := &model.Task{LocalPath: local, TargetDir: dir}
+		if err := NewWebdavUploader(cfg, xapp.UploaderOptions{}).Upload(task); err != nil {
+			t.Fatal(err)
+		}
+		return task
+	}
+
+	endpoint := server.URL + "/remote.php/dav/files/me/up"
+	task := upload(WebdavConfig{Endpoint: endpoint, Auth: "digest", Username: "me", Password: "secret"}, "2024/05")
+	if want := endpoint + "/2024/05/a%20b.png"; task.Url != want {
+		t.Errorf("url %s, want %s", task.Url, want)
+	}
+	if dav.files["up/2024/05/a b.png"] != "png" {
+		t.Errorf("file not uploaded, got %v", dav.files)
+	}
+	want := "MKCOL /remote.php/dav/files/me/up/2024/,MKCOL /remote.php/dav/files/me/up/2024/05/,PUT /remote.php/dav/files/me/up/2024/05/a b.png"
+	if got := strings.Join(dav.requests, ","); got != want {
+		t.Errorf("requests %s, want %s", got, want)
+	}
+
+	dav.basic = true
+	task = upload(WebdavConfig{Endpoint: endpoint, Username: "me", Password: "secret", Share: true, ShareDownload: true}, "2024/05")
+	if want := "https://cloud.example.com/s/abc/download"; task.Url != want {
+		t.Errorf("share url %s, want %s", task.Url, want)
+	}
+	if want := "/up/2024/05/a b.png"; dav.shared != want {
+		t.Errorf("shared %s, want %s", dav.shared, want)
+	}
+}
+
+func TestDigestAmongChallenges(t *testing.T) {
+	dav := &fakeDav{offerBasic: true, cols: make(map[string]bool), files: make(map[string]string)}
+	server := httptest.NewServer(dav)
+	defer server.Close()
+	local := filepath.Join(t.TempDir(), "a.png")
+	if err := os.WriteFile(local, []byte("png"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := WebdavConfig{Endpoint: server.URL + "/remote.php/dav/files/me", Auth: "digest", Username: "me", Password: "secret"}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewWebdavUploader(cfg, xapp.UploaderOptions{}).Upload(&model.Task{LocalPath: local}); err != nil {
+		t.Fatal(err)
+	}
+	if len(dav.files) != 1 {
+		t.Errorf("files %v, want one", dav.files)
+	}
+}
+
+func TestShareRoot(t *testing.T) {
+	tests := []struct {
+		endpoint, server, dir string
+		ok                    bool
+	}{
+		{"https://cloud.example.com/remote.php/dav/files/me", "https://cloud.example.com", "/", true},
+		{"https://example.com/nextcloud/remote.php/dav/files/me/my%20pics/", "https://example.com/nextcloud", "/my pics", true},
+		{"https://owncloud.example.com/remote.php/webdav/img", "https://owncloud.example.com", "/img", true},
+		{"https://nas.example.com/dav", "", "", false},
+	}
+	for _, tt := range tests {
+		server, dir, ok := WebdavConfig{Endpoint: tt.endpoint}.shareRoot()
+		if server != tt.server || dir != tt.dir || ok != tt.ok {
+			t.Errorf("shareRoot(%s) = %s, %s, %v", tt.endpoint, server, dir, ok)
+		}
+	}
+}
@@ -1,10 +1,17 @@
 package xapp
 
+import "github.com/pluveto/upgit/lib/xretry"
+
 type Config struct {
 	DefaultUploader string            `toml:"default_uploader,omitempty"`
 	Rename          string            `toml:"rename,omitempty"`
 	Replacements    map[string]string `toml:"replacements,omitempty"`
 	OutputFormats   map[string]string `toml:"output_formats,omitempty"`
+	Concurrency     int               `toml:"concurrency,omitempty"`
+	Retry           xretry.Policy     `toml:"retry,omitempty"`
+	ConnectTimeout  int               `toml:"connect_timeout,omitempty"`
+	Timeout         int               `toml:"timeout,omitempty"`
+	CAFile          string            `toml:"ca_file,omitempty"`
 }
 
 var AppCfg Config
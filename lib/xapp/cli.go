@@ -10,7 +10,7 @@ const (
 const kRepoURL = "https://github.com/pluveto/upgit"
 
 type CLIOptions struct {
-	LocalPaths   []string   `arg:"positional, required" placeholder:"FILE" help:"local file path to upload. :clipboard for uploading clipboard image"`
+	LocalPaths   []string   `arg:"positional, required" placeholder:"FILE" help:"local file path to upload. :clipboard for uploading clipboard image, :clipboard-text for clipboard text, - for stdin"`
 	TargetDir    string     `arg:"-t,--target-dir"    help:"upload file with original name to given directory. if not set, will use renaming rules"`
 	Verbose      bool       `arg:"-V,--verbose"       help:"when set, output more details to help developers"`
 	SizeLimit    *int64     `arg:"-s,--size-limit"    help:"in bytes. overwrite default size limit (5MiB). 0 means no limit"`
@@ -22,6 +22,8 @@ type CLIOptions struct {
 	Uploader     string     `arg:"-u,--uploader"      help:"uploader to use. if not set, will follow config"`
 	OutputType   OutputType `arg:"-o,--output-type"   help:"output type, supports stdout, clipboard" default:"stdout"`
 	OutputFormat string     `arg:"-f,--output-format" help:"output format, supports url, markdown and your customs" default:"url"`
+	Jobs         int        `arg:"-j,--jobs"          help:"number of files uploaded in parallel. if not set, will follow config"`
+	Progress     string     `arg:"--progress"         help:"progress output to stderr, supports auto, bar, json, none. auto shows bar on terminal" default:"auto"`
 
 	ApplicationPath string `arg:"--application-path" help:"custom application path, which determines config file path and extensions dir path. current binary dir by default"`
 }
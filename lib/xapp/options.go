@@ -0,0 +1,105 @@
+package xapp
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pluveto/upgit/lib/model"
+	"github.com/pluveto/upgit/lib/xhttp"
+	"github.com/pluveto/upgit/lib/xretry"
+)
+
+const DefaultConnectTimeout = 15
+
+const (
+	URLModePublic    = "public"
+	URLModePresigned = "presigned"
+	// DefaultURLExpire is 7 days, the longest one S3 accepts
+	DefaultURLExpire = 7 * 24 * 3600
+)
+
+// UploaderOptions are options understood by every uploader. They are set at
+// the top level of config, and can be overridden in [uploaders.<id>]
+type UploaderOptions struct {
+	Retry xretry.Policy `toml:"retry,omitempty" mapstructure:"retry"`
+	// ConnectTimeout limits dialing and TLS handshake, in seconds
+	ConnectTimeout int `toml:"connect_timeout,omitempty" mapstructure:"connect_timeout"`
+	// Timeout limits a whole request, in seconds. 0 means no limit
+	Timeout int `toml:"timeout,omitempty" mapstructure:"timeout"`
+	// URLMode is either public or presigned. Presigned urls can read objects
+	// in private buckets until they expire, URLExpire seconds after upload.
+	URLMode   string `toml:"url_mode,omitempty" mapstructure:"url_mode"`
+	URLExpire int    `toml:"url_expire,omitempty" mapstructure:"url_expire"`
+	// Metadata is set on uploaded objects by cloud storage uploaders
+	Metadata model.Metadata `toml:"metadata,omitempty" mapstructure:"metadata"`
+	// CAFile is a PEM bundle of certificates trusted besides system ones,
+	// for servers with a private CA
+	CAFile string `toml:"ca_file,omitempty" mapstructure:"ca_file"`
+
+	client *http.Client
+}
+
+// Validate checks options set by user
+func (o UploaderOptions) Validate() error {
+	switch o.URLMode {
+	case URLModePublic, URLModePresigned:
+	default:
+		return fmt.Errorf("unknown url_mode %q, supports %s and %s", o.URLMode, URLModePublic, URLModePresigned)
+	}
+	if o.URLExpire <= 0 {
+		return fmt.Errorf("url_expire must be positive, got %d", o.URLExpire)
+	}
+	return nil
+}
+
+// Presigned tells whether urls should be presigned, and for how long they are valid
+func (o UploaderOptions) Presigned() (bool, time.Duration) {
+	return o.URLMode == URLModePresigned, time.Duration(o.URLExpire) * time.Second
+}
+
+// HTTPClient returns the client built from options
+func (o UploaderOptions) HTTPClient() *http.Client {
+	if o.client == nil {
+		return http.DefaultClient
+	}
+	return o.client
+}
+
+// LoadUploaderOptions loads options of given uploader, falling back to global ones
+func LoadUploaderOptions(uploaderId string) (UploaderOptions, error) {
+	opts, err := LoadUploaderConfig[UploaderOptions](uploaderId)
+	if err != nil {
+		opts = UploaderOptions{}
+	}
+	opts.Retry = opts.Retry.Merge(AppCfg.Retry).Merge(xretry.DefaultPolicy)
+	if opts.ConnectTimeout == 0 {
+		opts.ConnectTimeout = AppCfg.ConnectTimeout
+	}
+	if opts.ConnectTimeout == 0 {
+		opts.ConnectTimeout = DefaultConnectTimeout
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = AppCfg.Timeout
+	}
+	if opts.URLMode == "" {
+		opts.URLMode = URLModePublic
+	}
+	if opts.URLExpire == 0 {
+		opts.URLExpire = DefaultURLExpire
+	}
+	if opts.CAFile == "" {
+		opts.CAFile = AppCfg.CAFile
+	}
+	var rootCAs *x509.CertPool
+	if opts.CAFile != "" {
+		var err error
+		rootCAs, err = xhttp.LoadCertPool(opts.CAFile)
+		if err != nil {
+			return opts, fmt.Errorf("ca_file: %w", err)
+		}
+	}
+	opts.client = xhttp.NewClient(time.Duration(opts.ConnectTimeout)*time.Second, time.Duration(opts.Timeout)*time.Second, rootCAs)
+	return opts, nil
+}
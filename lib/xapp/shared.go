@@ -19,6 +19,8 @@ const DefaultBranch = "master"
 // case insensitive
 const ClipboardPlaceholder = ":clipboard"
 const ClipboardFilePlaceholder = ":clipboard-file"
+const ClipboardTextPlaceholder = ":clipboard-text"
+const StdinPlaceholder = "-"
 
 var MaxUploadSize = int64(5 * 1024 * 1024)
 var ConfigFilePath string
@@ -69,7 +71,8 @@ func LoadUploaderConfig[T any](uploaderId string) (ret T, err error) {
 	if err != nil {
 		return
 	}
-	cfgMap := mCfg["uploaders"].(map[string]interface{})[uploaderId]
+	uploadersCfg, _ := mCfg["uploaders"].(map[string]interface{})
+	cfgMap := uploadersCfg[uploaderId]
 	var cfg_ T
 	mapstructure.Decode(cfgMap, &cfg_)
 	ret = cfg_
@@ -0,0 +1,27 @@
+// Package xgit has helpers for git objects, shared by uploaders of git hosts
+package xgit
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"strconv"
+
+	"github.com/pluveto/upgit/lib/xio"
+)
+
+// BlobSHA returns the object id git gives to the content of file at path,
+// the one `git hash-object` prints
+func BlobSHA(path string) (string, error) {
+	file, size, err := xio.OpenFile(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := sha1.New()
+	io.WriteString(h, "blob "+strconv.FormatInt(size, 10)+"\x00")
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
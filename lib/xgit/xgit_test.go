@@ -0,0 +1,31 @@
+package xgit
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestBlobSHA(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		content string
+		want    string
+	}{
+		{"hello\n", "ce013625030ba8dba906f756967f9e9ca394464a"},
+		{"", "e69de29bb2d1d6434b8b29ae775ad8c2e48c5391"},
+	}
+	for i, tt := range tests {
+		path := filepath.Join(dir, string(rune('a'+i)))
+		if err := ioutil.WriteFile(path, []byte(tt.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := BlobSHA(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("BlobSHA(%q) = %s, want %s", tt.content, got, tt.want)
+		}
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"regexp"
 
 	"github.com/pluveto/upgit/lib/xapp"
 )
@@ -28,6 +27,29 @@ type Links struct {
 	HTML string `json:"html"`
 }
 
+// Release is a GitHub release
+type Release struct {
+	ID      int64  `json:"id"`
+	TagName string `json:"tag_name"`
+	Name    string `json:"name"`
+	// UploadURL is a URI template like
+	// https://uploads.github.com/repos/o/r/releases/1/assets{?name,label}
+	UploadURL string  `json:"upload_url"`
+	HTMLURL   string  `json:"html_url"`
+	Assets    []Asset `json:"assets"`
+}
+
+// Asset is a file attached to a release
+type Asset struct {
+	ID          int64  `json:"id"`
+	Name        string `json:"name"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type"`
+	// State is "uploaded", or "open" for an upload not completed
+	State              string `json:"state"`
+	BrowserDownloadURL string `json:"browser_download_url"`
+}
+
 func trimSlash(path string) string {
 	if path[0] == '/' {
 		path = path[1:]
@@ -111,16 +133,21 @@ func GetLatestReleaseDownloadUrl(repo string) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	defer resp.Body.Close()
 	bodyBuf, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return "", err
 	}
-	jsonStr := string(bodyBuf)
-	// find "browser_download_url": "{link}"
-	re := regexp.MustCompile(`"browser_download_url":\s*"([^"]+)"`)
-	matches := re.FindStringSubmatch(jsonStr)
-	if len(matches) < 2 {
-		return "", fmt.Errorf("cannot find browser_download_url in %s", jsonStr)
+	if !(200 <= resp.StatusCode && resp.StatusCode < 300) {
+		return "", fmt.Errorf("%d %s", resp.StatusCode, bodyBuf)
+	}
+	var release Release
+	err = json.Unmarshal(bodyBuf, &release)
+	if err != nil {
+		return "", err
+	}
+	if len(release.Assets) == 0 {
+		return "", fmt.Errorf("release %s of %s has no asset", release.TagName, repo)
 	}
-	return matches[1], nil
+	return release.Assets[0].BrowserDownloadURL, nil
 }
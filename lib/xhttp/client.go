@@ -0,0 +1,48 @@
+package xhttp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+// NewClient creates a http client. connectTimeout limits dialing and TLS
+// handshake, timeout limits the whole request including reading response.
+// Zero means no limit. rootCAs replaces system certificates if not nil.
+func NewClient(connectTimeout, timeout time.Duration, rootCAs *x509.CertPool) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if connectTimeout > 0 {
+		transport.DialContext = (&net.Dialer{
+			Timeout:   connectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+		transport.TLSHandshakeTimeout = connectTimeout
+	}
+	if rootCAs != nil {
+		transport.TLSClientConfig = &tls.Config{RootCAs: rootCAs}
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+	}
+}
+
+// LoadCertPool returns system certificates plus PEM encoded ones in file
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(buf) {
+		return nil, errors.New("no certificate found in " + file)
+	}
+	return pool, nil
+}
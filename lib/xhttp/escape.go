@@ -0,0 +1,16 @@
+package xhttp
+
+import (
+	"net/url"
+	"strings"
+)
+
+// EscapePath percent-encodes each segment of a slash separated path, so that
+// spaces and non-ASCII names make valid urls. Slashes are kept.
+func EscapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
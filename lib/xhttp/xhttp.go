@@ -24,7 +24,8 @@ func (wc *WriteCounter) Write(p []byte) (int, error) {
 	return n, nil
 }
 
-func humanizeBytes(bytes uint64) string {
+// HumanizeBytes formats bytes like 1.5 MB
+func HumanizeBytes(bytes uint64) string {
 	const unit = 1024
 	if bytes < unit {
 		return fmt.Sprintf("%d B", bytes)
@@ -45,7 +46,7 @@ func (wc WriteCounter) PrintProgress() {
 
 	// Return again and print current status of download
 	// We use the humanize package to print the bytes in a meaningful way (e.g. 10 MB)
-	fmt.Printf("\rDownloading... %s complete", humanizeBytes(wc.Total))
+	fmt.Printf("\rDownloading... %s complete", HumanizeBytes(wc.Total))
 }
 
 // DownloadFile will download a url and store it in local filepath.
@@ -0,0 +1,24 @@
+package xio
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// LockFile takes an exclusive lock on the file at path, creating it if
+// missing, to keep other processes out of what it guards. It waits while
+// another process holds the lock. Closing the returned file releases it.
+func LockFile(path string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(file); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+
+package xio
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockFile locks file exclusively, waiting while another process holds it
+func lockFile(file *os.File) error {
+	return unix.Flock(int(file.Fd()), unix.LOCK_EX)
+}
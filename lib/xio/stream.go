@@ -0,0 +1,92 @@
+package xio
+
+import (
+	"encoding/base64"
+	"io"
+	"os"
+)
+
+// OpenFile opens a file for reading and returns its size
+func OpenFile(path string) (file *os.File, size int64, err error) {
+	file, err = os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return file, stat.Size(), nil
+}
+
+// MultiReadCloser reads readers one after another like io.MultiReader.
+// Closing it closes every reader which is an io.Closer.
+func MultiReadCloser(readers ...io.Reader) io.ReadCloser {
+	return &multiReadCloser{Reader: io.MultiReader(readers...), readers: readers}
+}
+
+type multiReadCloser struct {
+	io.Reader
+	readers []io.Reader
+}
+
+func (m *multiReadCloser) Close() (err error) {
+	for _, r := range m.readers {
+		if c, ok := r.(io.Closer); ok {
+			if cerr := c.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+	}
+	return
+}
+
+// Base64Len returns the length of standard base64 encoding of n bytes
+func Base64Len(n int64) int64 {
+	return (n + 2) / 3 * 4
+}
+
+// Base64Reader returns a reader of standard base64 encoding of src. Data is
+// encoded chunk by chunk while reading, so memory use doesn't grow with size
+// of src. Closing it closes src if src is an io.Closer.
+func Base64Reader(src io.Reader) io.ReadCloser {
+	return &base64Reader{src: src}
+}
+
+type base64Reader struct {
+	src io.Reader
+	err error
+	in  [3 * 1024]byte
+	buf [4 * 1024]byte
+	out []byte
+}
+
+func (r *base64Reader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		// read full chunks so that no padding appears before the end
+		n, err := io.ReadFull(r.src, r.in[:])
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			r.err = io.EOF
+		} else if err != nil {
+			r.err = err
+		}
+		if n > 0 {
+			base64.StdEncoding.Encode(r.buf[:], r.in[:n])
+			r.out = r.buf[:base64.StdEncoding.EncodedLen(n)]
+		}
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+func (r *base64Reader) Close() error {
+	if c, ok := r.src.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
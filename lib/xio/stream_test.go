@@ -0,0 +1,30 @@
+package xio
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"testing/iotest"
+)
+
+func TestBase64Reader(t *testing.T) {
+	for _, size := range []int{0, 1, 2, 3, 3071, 3072, 3073, 100000} {
+		data := make([]byte, size)
+		rand.Read(data)
+		want := base64.StdEncoding.EncodeToString(data)
+
+		// one byte reader makes every chunk short
+		got, err := ioutil.ReadAll(Base64Reader(iotest.OneByteReader(bytes.NewReader(data))))
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if string(got) != want {
+			t.Errorf("size %d: encoding mismatch", size)
+		}
+		if Base64Len(int64(size)) != int64(len(want)) {
+			t.Errorf("Base64Len(%d) = %d, want %d", size, Base64Len(int64(size)), len(want))
+		}
+	}
+}
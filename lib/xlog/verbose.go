@@ -5,6 +5,7 @@ import (
 	"os"
 	"runtime/debug"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pelletier/go-toml/v2"
@@ -14,6 +15,10 @@ import (
 // GVerbose is a global verbose
 var GVerbose Verbose
 
+// outputMu serializes console and log file writes, so that GVerbose can be
+// shared by concurrent upload tasks
+var outputMu sync.Mutex
+
 type Verbose struct {
 	VerboseEnabled bool
 	LogEnabled     bool
@@ -24,7 +29,9 @@ type Verbose struct {
 func (v Verbose) Trace(fmt_ string, args ...interface{}) {
 	_, message := toMessage("[TRACE] ", fmt_, args...)
 	if v.VerboseEnabled {
-		fmt.Printf(message)
+		outputMu.Lock()
+		defer outputMu.Unlock()
+		fmt.Print(message)
 	}
 }
 
@@ -46,8 +53,10 @@ func (v Verbose) Error(fmt_ string, args ...interface{}) {
 
 func (v Verbose) Log(level, fmt_ string, args ...interface{}) {
 	log, message := toMessage(level, fmt_, args...)
+	outputMu.Lock()
+	defer outputMu.Unlock()
 	if v.VerboseEnabled {
-		fmt.Printf(message)
+		fmt.Print(message)
 	}
 	if v.LogEnabled && len(v.LogFile) > 0 {
 		xio.AppendToFile(v.LogFile, []byte(log))
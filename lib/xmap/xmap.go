@@ -2,6 +2,7 @@ package xmap
 
 import (
 	"errors"
+	"fmt"
 	"regexp"
 	"strconv"
 	"strings"
@@ -42,16 +43,57 @@ func GetDeep[T any](m map[string]interface{}, path string) (ret T, err error) {
 		if v, ok := m[key]; ok {
 			switch v.(type) {
 			case []interface{}:
-				return v.([]interface{})[arrIndex].(T), nil
+				arr := v.([]interface{})
+				if arrIndex >= len(arr) {
+					err = errors.New("for path " + path + ", index of key " + key + " out of range")
+					return
+				}
+				return typed[T](path, arr[arrIndex])
 			case map[string]interface{}:
 				m = v.(map[string]interface{})
 			default:
-				return v.(T), nil
+				return typed[T](path, v)
 			}
 		} else {
 			err = errors.New("for path " + path + ", key " + key + " not found")
 			return
 		}
 	}
-	return interface{}(m).(T), nil
+	return typed[T](path, m)
+}
+
+func typed[T any](path string, v interface{}) (ret T, err error) {
+	ret, ok := v.(T)
+	if !ok {
+		err = fmt.Errorf("for path %s, unexpected value type %T", path, v)
+	}
+	return
+}
+
+// DeepCopy returns a copy of m in which nested maps and slices are copied too,
+// so that the result can be modified without touching m
+func DeepCopy(m map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return nil
+	}
+	ret := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		ret[k] = deepCopyValue(v)
+	}
+	return ret
+}
+
+func deepCopyValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return DeepCopy(v)
+	case []interface{}:
+		ret := make([]interface{}, len(v))
+		for i, e := range v {
+			ret[i] = deepCopyValue(e)
+		}
+		return ret
+	default:
+		return v
+	}
 }
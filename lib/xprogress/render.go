@@ -0,0 +1,119 @@
+package xprogress
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pluveto/upgit/lib/xhttp"
+)
+
+// JSONReporter writes every event as a line of JSON
+type JSONReporter struct {
+	W  io.Writer
+	mu sync.Mutex
+}
+
+func (r *JSONReporter) Report(e Event) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.W.Write(append(line, '\n'))
+}
+
+// BarReporter draws a progress bar per task on a terminal
+type BarReporter struct {
+	W     io.Writer
+	Width int
+
+	mu     sync.Mutex
+	order  []int
+	events map[int]Event
+	drawn  int
+}
+
+func (r *BarReporter) Report(e Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.events == nil {
+		r.events = make(map[int]Event)
+	}
+	if _, ok := r.events[e.TaskId]; !ok {
+		r.order = append(r.order, e.TaskId)
+	}
+	r.events[e.TaskId] = e
+
+	var buf strings.Builder
+	// move back to the first line drawn last time and redraw all of them
+	if r.drawn > 0 {
+		fmt.Fprintf(&buf, "\x1b[%dA", r.drawn)
+	}
+	for _, id := range r.order {
+		buf.WriteString("\r\x1b[2K")
+		buf.WriteString(r.line(r.events[id]))
+		buf.WriteString("\n")
+	}
+	r.drawn = len(r.order)
+	io.WriteString(r.W, buf.String())
+}
+
+// Clear erases the bars, so that other output won't be mixed with them.
+// Bars of finished tasks are forgotten, the others are drawn again on next event.
+func (r *BarReporter) Clear() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.drawn > 0 {
+		io.WriteString(r.W, fmt.Sprintf("\x1b[%dA\r\x1b[J", r.drawn))
+		r.drawn = 0
+	}
+	var order []int
+	for _, id := range r.order {
+		if r.events[id].Done {
+			delete(r.events, id)
+			continue
+		}
+		order = append(order, id)
+	}
+	r.order = order
+}
+
+func (r *BarReporter) line(e Event) string {
+	width := r.Width
+	if width <= 0 {
+		width = 30
+	}
+	ratio := 0.0
+	if e.Total > 0 {
+		ratio = float64(e.Sent) / float64(e.Total)
+	}
+	if ratio > 1 {
+		ratio = 1
+	}
+	filled := int(ratio * float64(width))
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", width-filled)
+	status := fmt.Sprintf("%s/s", xhttp.HumanizeBytes(uint64(e.Rate)))
+	switch {
+	case e.Failed:
+		status = "failed"
+	case e.Done:
+		status = "done"
+	case e.ETA >= 0:
+		status += " ETA " + (time.Duration(e.ETA) * time.Second).String()
+	}
+	return fmt.Sprintf("%-24s [%s] %3.0f%% %9s/%-9s %s",
+		shorten(e.Name, 24), bar, ratio*100, xhttp.HumanizeBytes(uint64(e.Sent)), xhttp.HumanizeBytes(uint64(e.Total)), status)
+}
+
+func shorten(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-3]) + "..."
+}
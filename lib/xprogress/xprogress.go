@@ -0,0 +1,211 @@
+package xprogress
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// Event describes how far the upload of a task is
+type Event struct {
+	TaskId int    `json:"task_id"`
+	Name   string `json:"name"`
+	Sent   int64  `json:"sent"`
+	Total  int64  `json:"total"`
+	// Rate in bytes per second
+	Rate float64 `json:"rate"`
+	// ETA in seconds, -1 if unknown
+	ETA    float64 `json:"eta"`
+	Done   bool    `json:"done"`
+	Failed bool    `json:"failed,omitempty"`
+}
+
+// Reporter receives progress events. It must be safe for concurrent use.
+type Reporter interface {
+	Report(e Event)
+}
+
+type reporterKey struct{}
+
+type taskKey struct{}
+
+type taskInfo struct {
+	id   int
+	name string
+}
+
+// WithReporter returns a context delivering progress events to r
+func WithReporter(ctx context.Context, r Reporter) context.Context {
+	return context.WithValue(ctx, reporterKey{}, r)
+}
+
+// WithTask returns a context whose progress events belong to given task
+func WithTask(ctx context.Context, taskId int, name string) context.Context {
+	return context.WithValue(ctx, taskKey{}, taskInfo{id: taskId, name: name})
+}
+
+// ReportInterval throttles events of a tracker
+var ReportInterval = 100 * time.Millisecond
+
+// Tracker follows the bytes sent for a task. A nil Tracker is valid and
+// reports nothing, so uploaders don't need to check whether progress is wanted.
+type Tracker struct {
+	reporter Reporter
+	task     taskInfo
+	total    int64
+
+	mu         sync.Mutex
+	sent       int64
+	start      time.Time
+	lastReport time.Time
+	finished   bool
+}
+
+// Start creates a tracker for total bytes of the task in ctx.
+// It returns nil if ctx has no reporter.
+func Start(ctx context.Context, total int64) *Tracker {
+	r, _ := ctx.Value(reporterKey{}).(Reporter)
+	if r == nil {
+		return nil
+	}
+	task, _ := ctx.Value(taskKey{}).(taskInfo)
+	t := &Tracker{
+		reporter: r,
+		task:     task,
+		total:    total,
+		start:    time.Now(),
+	}
+	t.report(false, false)
+	return t
+}
+
+// Add records n more bytes sent
+func (t *Tracker) Add(n int64) {
+	if t == nil || n == 0 {
+		return
+	}
+	t.mu.Lock()
+	t.sent += n
+	t.mu.Unlock()
+	t.maybeReport()
+}
+
+// Set records the total bytes sent so far
+func (t *Tracker) Set(sent int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.sent = sent
+	t.mu.Unlock()
+	t.maybeReport()
+}
+
+// Finish reports the final event. err is the result of uploading.
+func (t *Tracker) Finish(err error) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	if t.finished {
+		t.mu.Unlock()
+		return
+	}
+	t.finished = true
+	t.mu.Unlock()
+	t.report(true, err != nil)
+}
+
+func (t *Tracker) maybeReport() {
+	t.mu.Lock()
+	due := time.Since(t.lastReport) >= ReportInterval || (t.total > 0 && t.sent >= t.total)
+	t.mu.Unlock()
+	if due {
+		t.report(false, false)
+	}
+}
+
+func (t *Tracker) report(done, failed bool) {
+	t.mu.Lock()
+	now := time.Now()
+	t.lastReport = now
+	e := Event{
+		TaskId: t.task.id,
+		Name:   t.task.name,
+		Sent:   t.sent,
+		Total:  t.total,
+		ETA:    -1,
+		Done:   done,
+		Failed: failed,
+	}
+	t.mu.Unlock()
+	if elapsed := now.Sub(t.start).Seconds(); elapsed > 0 {
+		e.Rate = float64(e.Sent) / elapsed
+	}
+	if e.Rate > 0 && e.Total > 0 {
+		e.ETA = float64(e.Total-e.Sent) / e.Rate
+	}
+	if done {
+		e.ETA = 0
+	}
+	t.reporter.Report(e)
+}
+
+// Reader wraps r, counting bytes read from it as sent
+func (t *Tracker) Reader(r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+	return &reader{r: r, t: t}
+}
+
+// ReadCloser wraps r like Reader, keeping it closable
+func (t *Tracker) ReadCloser(r io.ReadCloser) io.ReadCloser {
+	if t == nil {
+		return r
+	}
+	return &readCloser{reader: reader{r: r, t: t}, c: r}
+}
+
+// ReadSeeker wraps r like Reader. Seeking moves the count of bytes sent, as
+// some SDKs read the body more than once.
+func (t *Tracker) ReadSeeker(r io.ReadSeeker) io.ReadSeeker {
+	if t == nil {
+		return r
+	}
+	return &readSeeker{reader: reader{r: r, t: t}, s: r}
+}
+
+type reader struct {
+	r io.Reader
+	t *Tracker
+}
+
+func (r *reader) Read(p []byte) (n int, err error) {
+	n, err = r.r.Read(p)
+	r.t.Add(int64(n))
+	return
+}
+
+type readCloser struct {
+	reader
+	c io.Closer
+}
+
+func (r *readCloser) Close() error {
+	return r.c.Close()
+}
+
+type readSeeker struct {
+	reader
+	s io.Seeker
+}
+
+func (r *readSeeker) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.s.Seek(offset, whence)
+	if err == nil {
+		r.t.Set(pos)
+	}
+	return pos, err
+}
@@ -0,0 +1,370 @@
+package xresume
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pluveto/upgit/lib/xio"
+	"github.com/pluveto/upgit/lib/xlog"
+	"github.com/pluveto/upgit/lib/xprogress"
+)
+
+// Defaults of Sizing, and the most parts a multipart upload may have on S3
+// and the services following its api
+const (
+	DefaultThresholdMB = 64
+	DefaultPartSizeMB  = 16
+	DefaultConcurrency = 4
+	MaxParts           = 10000
+)
+
+// ErrNoSuchUpload is returned by Service.ListParts when the upload is gone
+var ErrNoSuchUpload = errors.New("no such upload")
+
+// Sizing tells how files are split into parts. Files larger than ThresholdMB
+// are uploaded in parts of PartSizeMB, Concurrency at a time. Zero values
+// fall back to the defaults.
+type Sizing struct {
+	ThresholdMB int64
+	PartSizeMB  int64
+	Concurrency int
+	// MinPartSize is the smallest part in bytes taken by the service
+	MinPartSize int64
+}
+
+// Threshold returns size in bytes above which files are uploaded in parts
+func (s Sizing) Threshold() int64 {
+	if s.ThresholdMB > 0 {
+		return s.ThresholdMB << 20
+	}
+	return DefaultThresholdMB << 20
+}
+
+// PartSize returns size of each part for a file of given size, growing the
+// configured one when the file would need too many parts
+func (s Sizing) PartSize(size int64) int64 {
+	partSize := int64(DefaultPartSizeMB) << 20
+	if s.PartSizeMB > 0 {
+		partSize = s.PartSizeMB << 20
+	}
+	if partSize < s.MinPartSize {
+		partSize = s.MinPartSize
+	}
+	for (size+partSize-1)/partSize > MaxParts {
+		partSize *= 2
+	}
+	return partSize
+}
+
+// PartConcurrency returns how many parts are uploaded at a time
+func (s Sizing) PartConcurrency() int {
+	if s.Concurrency > 0 {
+		return s.Concurrency
+	}
+	return DefaultConcurrency
+}
+
+// PartLength returns length of the part with given number, the last part
+// being shorter
+func PartLength(number int, partSize, size int64) int64 {
+	length := size - int64(number-1)*partSize
+	if length > partSize {
+		length = partSize
+	}
+	return length
+}
+
+// Upload is an unfinished multipart upload on the server
+type Upload struct {
+	Key      string
+	UploadId string
+}
+
+// Service is the multipart api of a storage service
+type Service interface {
+	// Create starts a multipart upload of localPath to key and returns its id
+	Create(ctx context.Context, localPath, key string) (string, error)
+	// ListParts returns the parts the server has. It returns ErrNoSuchUpload
+	// if the upload no longer exists.
+	ListParts(ctx context.Context, key, uploadId string) ([]Part, error)
+	// UploadPart uploads a part and returns its etag
+	UploadPart(ctx context.Context, key, uploadId string, number int, body io.ReadSeeker, length int64) (string, error)
+	// Complete joins parts, sorted by number, into the object
+	Complete(ctx context.Context, key, uploadId string, parts []Part) error
+	// ListUploads returns all unfinished uploads in the bucket
+	ListUploads(ctx context.Context) ([]Upload, error)
+	// Abort drops an upload and its parts. Aborting an upload which no
+	// longer exists is not an error.
+	Abort(ctx context.Context, key, uploadId string) error
+}
+
+// Uploader uploads files in parts to a bucket, saving the progress in Store
+type Uploader struct {
+	// Name, Endpoint and Bucket tell which states belong to the uploader
+	Name     string
+	Endpoint string
+	Bucket   string
+	Sizing   Sizing
+	// Store is DefaultStore() if its Dir is not set
+	Store Store
+	// Service may be nil for an uploader driving the parts by itself, which
+	// then uses only the state keeping of Uploader
+	Service Service
+}
+
+// StateStore returns the store in use
+func (u Uploader) StateStore() Store {
+	if u.Store.Dir != "" {
+		return u.Store
+	}
+	return DefaultStore()
+}
+
+// Owns tells whether state is of an upload made by u
+func (u Uploader) Owns(state *State) bool {
+	return state.Uploader == u.Name && state.Endpoint == u.Endpoint && state.Bucket == u.Bucket
+}
+
+// States returns saved states of uploads made by u by their ids
+func (u Uploader) States() (map[string]*State, error) {
+	states, err := u.StateStore().List()
+	if err != nil {
+		return nil, err
+	}
+	for id, state := range states {
+		if !u.Owns(state) {
+			delete(states, id)
+		}
+	}
+	return states, nil
+}
+
+// Resume looks for an unfinished upload of the file. It returns id of the
+// upload state, and the key to upload to, which is the one of the unfinished
+// upload if there is any, as renaming rules may give another one now.
+func (u Uploader) Resume(localPath, targetDir, key string) (string, string) {
+	id, err := Identify(localPath, u.Name, u.Endpoint, u.Bucket, targetDir)
+	if err != nil {
+		return "", key
+	}
+	state, err := u.StateStore().Load(id)
+	if err != nil {
+		xlog.GVerbose.Info("ignored broken upload state %s: %s", id, err.Error())
+		return id, key
+	}
+	if state != nil {
+		xlog.GVerbose.Info("found unfinished upload of %s", localPath)
+		return id, state.Key
+	}
+	return id, key
+}
+
+// Save writes state of an upload of localPath to key, of which uploadId may
+// be empty if it is kept elsewhere
+func (u Uploader) Save(stateId, localPath, key, uploadId string) (*State, error) {
+	abs, err := filepath.Abs(localPath)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := os.Stat(abs)
+	if err != nil {
+		return nil, err
+	}
+	state := &State{
+		Uploader:  u.Name,
+		Endpoint:  u.Endpoint,
+		Bucket:    u.Bucket,
+		Key:       key,
+		UploadId:  uploadId,
+		LocalPath: abs,
+		Size:      stat.Size(),
+		ModTime:   stat.ModTime(),
+		PartSize:  u.Sizing.PartSize(stat.Size()),
+		CreatedAt: time.Now(),
+	}
+	return state, u.StateStore().Save(stateId, state)
+}
+
+// Remove deletes the state of a finished or aborted upload
+func (u Uploader) Remove(stateId string) error {
+	return u.StateStore().Remove(stateId)
+}
+
+// Put uploads a file in parts, resuming the upload saved as stateId if any.
+// Each finished part is saved, so that a failed upload can be continued by
+// calling again.
+func (u Uploader) Put(ctx context.Context, stateId, localPath, key string) (err error) {
+	file, size, err := xio.OpenFile(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	tracker := xprogress.Start(ctx, size)
+	defer func() { tracker.Finish(err) }()
+
+	state, err := u.loadState(ctx, stateId, key, size)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		uploadId, err := u.Service.Create(ctx, localPath, key)
+		if err != nil {
+			return err
+		}
+		xlog.GVerbose.Info("created multipart upload %s for %s", uploadId, key)
+		if state, err = u.Save(stateId, localPath, key, uploadId); err != nil {
+			return err
+		}
+	}
+
+	done := make(map[int]bool)
+	for _, part := range state.Parts {
+		done[part.Number] = true
+		tracker.Add(part.Size)
+	}
+	var todo []int
+	for number := 1; int64(number-1)*state.PartSize < size; number++ {
+		if !done[number] {
+			todo = append(todo, number)
+		}
+	}
+	xlog.GVerbose.Info("upload %s: %d parts done, %d to go", state.UploadId, len(done), len(todo))
+
+	if err = u.uploadParts(ctx, file, size, stateId, state, todo, tracker); err != nil {
+		return err
+	}
+
+	sort.Slice(state.Parts, func(i, j int) bool { return state.Parts[i].Number < state.Parts[j].Number })
+	if err = u.Service.Complete(ctx, key, state.UploadId, state.Parts); err != nil {
+		return err
+	}
+	return u.Remove(stateId)
+}
+
+// loadState reads the saved state and checks it against the parts the server
+// has. It returns nil if there is nothing to resume.
+func (u Uploader) loadState(ctx context.Context, stateId, key string, size int64) (*State, error) {
+	state, err := u.StateStore().Load(stateId)
+	if err != nil || state == nil {
+		return nil, nil
+	}
+	if state.Key != key || state.Size != size || state.UploadId == "" {
+		return nil, nil
+	}
+	found, err := u.Service.ListParts(ctx, key, state.UploadId)
+	if errors.Is(err, ErrNoSuchUpload) {
+		xlog.GVerbose.Info("upload %s no longer exists, starting over", state.UploadId)
+		return nil, u.Remove(stateId)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var parts []Part
+	for _, part := range found {
+		// a part of unexpected size can't be reused
+		if part.Size == PartLength(part.Number, state.PartSize, size) {
+			parts = append(parts, part)
+		}
+	}
+	state.Parts = parts
+	return state, nil
+}
+
+// uploadParts uploads given parts concurrently and records them in state.
+// It stops at the first failure.
+func (u Uploader) uploadParts(ctx context.Context, file io.ReaderAt, size int64, stateId string, state *State, todo []int, tracker *xprogress.Tracker) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	store := u.StateStore()
+	numbers := make(chan int)
+	var mu sync.Mutex
+	var firstErr error
+	var wg sync.WaitGroup
+	for i := 0; i < u.Sizing.PartConcurrency(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for number := range numbers {
+				part, err := u.uploadPart(ctx, file, size, state, number)
+				mu.Lock()
+				if err == nil {
+					state.Parts = append(state.Parts, part)
+					err = store.Save(stateId, state)
+				}
+				if err != nil && firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				mu.Unlock()
+				if err == nil {
+					tracker.Add(part.Size)
+				}
+			}
+		}()
+	}
+feed:
+	for _, number := range todo {
+		select {
+		case numbers <- number:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(numbers)
+	wg.Wait()
+	if firstErr == nil {
+		return ctx.Err()
+	}
+	return firstErr
+}
+
+func (u Uploader) uploadPart(ctx context.Context, file io.ReaderAt, size int64, state *State, number int) (Part, error) {
+	length := PartLength(number, state.PartSize, size)
+	body := io.NewSectionReader(file, int64(number-1)*state.PartSize, length)
+	etag, err := u.Service.UploadPart(ctx, state.Key, state.UploadId, number, body, length)
+	if err != nil {
+		return Part{}, fmt.Errorf("part %d: %w", number, err)
+	}
+	return Part{Number: number, ETag: etag, Size: length}, nil
+}
+
+// Abort aborts unfinished uploads saved on this machine, or all the ones in
+// the bucket if all is set, and removes their states. It returns the aborted
+// uploads.
+func (u Uploader) Abort(ctx context.Context, all bool) (aborted []string, err error) {
+	states, err := u.States()
+	if err != nil {
+		return nil, err
+	}
+	var uploads []Upload
+	if all {
+		if uploads, err = u.Service.ListUploads(ctx); err != nil {
+			return nil, err
+		}
+	} else {
+		for _, state := range states {
+			uploads = append(uploads, Upload{state.Key, state.UploadId})
+		}
+	}
+	for _, up := range uploads {
+		if err := u.Service.Abort(ctx, up.Key, up.UploadId); err != nil {
+			return aborted, fmt.Errorf("abort %s: %w", up.Key, err)
+		}
+		aborted = append(aborted, up.Key+" ("+up.UploadId+")")
+	}
+	// states of aborted uploads are useless now
+	for id := range states {
+		if err := u.Remove(id); err != nil {
+			return aborted, err
+		}
+	}
+	return aborted, nil
+}
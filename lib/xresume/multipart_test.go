@@ -0,0 +1,128 @@
+package xresume
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// memService keeps one multipart upload in memory, failing the part numbered
+// failPart once
+type memService struct {
+	mu       sync.Mutex
+	uploadId string
+	parts    map[int][]byte
+	object   []byte
+	failPart int
+	sent     int
+}
+
+func (s *memService) Create(ctx context.Context, localPath, key string) (string, error) {
+	s.uploadId = "up1"
+	s.parts = make(map[int][]byte)
+	return s.uploadId, nil
+}
+
+func (s *memService) ListParts(ctx context.Context, key, uploadId string) ([]Part, error) {
+	if uploadId != s.uploadId {
+		return nil, ErrNoSuchUpload
+	}
+	var parts []Part
+	for number, buf := range s.parts {
+		parts = append(parts, Part{Number: number, ETag: strconv.Itoa(number), Size: int64(len(buf))})
+	}
+	return parts, nil
+}
+
+func (s *memService) UploadPart(ctx context.Context, key, uploadId string, number int, body io.ReadSeeker, length int64) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if number == s.failPart {
+		s.failPart = 0
+		return "", errors.New("broken")
+	}
+	buf, _ := io.ReadAll(body)
+	s.parts[number] = buf
+	s.sent++
+	return strconv.Itoa(number), nil
+}
+
+func (s *memService) Complete(ctx context.Context, key, uploadId string, parts []Part) error {
+	for _, part := range parts {
+		s.object = append(s.object, s.parts[part.Number]...)
+	}
+	s.uploadId = ""
+	return nil
+}
+
+func (s *memService) ListUploads(ctx context.Context) ([]Upload, error) {
+	return nil, nil
+}
+
+func (s *memService) Abort(ctx context.Context, key, uploadId string) error {
+	return nil
+}
+
+func TestUploaderResume(t *testing.T) {
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte("0123456789"), 1<<18)
+	localPath := filepath.Join(dir, "big.bin")
+	if err := os.WriteFile(localPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	service := &memService{failPart: 2}
+	u := Uploader{
+		Name:    "mem",
+		Sizing:  Sizing{PartSizeMB: 1, Concurrency: 1},
+		Store:   Store{Dir: filepath.Join(dir, "resume")},
+		Service: service,
+	}
+	id, key := u.Resume(localPath, "img", "img/big.bin")
+	if err := u.Put(context.Background(), id, localPath, key); err == nil {
+		t.Fatal("upload should fail at part 2")
+	}
+	states, err := u.States()
+	if err != nil || len(states[id].Parts) != 1 {
+		t.Fatalf("state of the failed upload %v, %v", states, err)
+	}
+
+	if _, got := u.Resume(localPath, "img", "img/renamed.bin"); got != key {
+		t.Errorf("resumed key %s, want %s", got, key)
+	}
+	if err := u.Put(context.Background(), id, localPath, key); err != nil {
+		t.Fatal(err)
+	}
+	// 2.5MB in 3 parts, the first one not sent again
+	if service.sent != 3 {
+		t.Errorf("sent %d parts, want 3", service.sent)
+	}
+	if !bytes.Equal(service.object, data) {
+		t.Error("uploaded content differs")
+	}
+	if states, _ := u.States(); len(states) != 0 {
+		t.Error("state should be removed after completion")
+	}
+}
+
+func TestPartSize(t *testing.T) {
+	tests := []struct {
+		sizing Sizing
+		size   int64
+		want   int64
+	}{
+		{Sizing{}, 100 << 20, DefaultPartSizeMB << 20},
+		{Sizing{PartSizeMB: 1, MinPartSize: 5 << 20}, 100 << 20, 5 << 20},
+		{Sizing{PartSizeMB: 1}, MaxParts<<20 + 1, 2 << 20},
+	}
+	for _, tt := range tests {
+		if got := tt.sizing.PartSize(tt.size); got != tt.want {
+			t.Errorf("%+v.PartSize(%d) = %d, want %d", tt.sizing, tt.size, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+// Package xresume keeps the state of unfinished multipart uploads on disk, so
+// that running the same command again continues where it stopped.
+package xresume
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pluveto/upgit/lib/xpath"
+)
+
+// State describes an unfinished multipart upload
+type State struct {
+	Uploader  string    `json:"uploader"`
+	Endpoint  string    `json:"endpoint"`
+	Bucket    string    `json:"bucket"`
+	Key       string    `json:"key"`
+	UploadId  string    `json:"upload_id"`
+	LocalPath string    `json:"local_path"`
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"mod_time"`
+	PartSize  int64     `json:"part_size"`
+	Parts     []Part    `json:"parts"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Part is an uploaded part of a multipart upload
+type Part struct {
+	Number int    `json:"number"`
+	ETag   string `json:"etag"`
+	Size   int64  `json:"size"`
+}
+
+// Store saves states as json files in Dir
+type Store struct {
+	Dir string
+}
+
+// DefaultStore keeps states in the application dir
+func DefaultStore() Store {
+	return Store{Dir: xpath.MustGetApplicationPath("resume")}
+}
+
+// Identify returns the id of state for uploading localPath to a destination
+// described by scope. The id changes when the file is modified, so a stale
+// upload is never resumed with new content.
+func Identify(localPath string, scope ...string) (string, error) {
+	abs, err := filepath.Abs(localPath)
+	if err != nil {
+		return "", err
+	}
+	stat, err := os.Stat(abs)
+	if err != nil {
+		return "", err
+	}
+	fields := append(append([]string{}, scope...), abs, strconv.FormatInt(stat.Size(), 10), strconv.FormatInt(stat.ModTime().UnixNano(), 10))
+	sum := sha1.Sum([]byte(strings.Join(fields, "\n")))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (s Store) path(id string) string {
+	return filepath.Join(s.Dir, id+".json")
+}
+
+// Load reads the state of given id. It returns nil if there is none.
+func (s Store) Load(id string) (*State, error) {
+	buf, err := ioutil.ReadFile(s.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state State
+	if err := json.Unmarshal(buf, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// Save writes state of given id, replacing the old one atomically
+func (s Store) Save(id string, state *State) error {
+	buf, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return err
+	}
+	tmp := s.path(id) + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path(id))
+}
+
+// Remove deletes state of given id. Removing a missing state is not an error.
+func (s Store) Remove(id string) error {
+	err := os.Remove(s.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// List returns all saved states by their ids
+func (s Store) List() (map[string]*State, error) {
+	files, err := ioutil.ReadDir(s.Dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	states := make(map[string]*State)
+	for _, f := range files {
+		id := strings.TrimSuffix(f.Name(), ".json")
+		if f.IsDir() || id == f.Name() {
+			continue
+		}
+		state, err := s.Load(id)
+		if err != nil {
+			return nil, err
+		}
+		states[id] = state
+	}
+	return states, nil
+}
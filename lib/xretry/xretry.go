@@ -0,0 +1,205 @@
+package xretry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pluveto/upgit/lib/xlog"
+)
+
+// Policy controls how many times and how often a failed operation is retried
+type Policy struct {
+	MaxAttempts int `toml:"max_attempts,omitempty" mapstructure:"max_attempts"`
+	BaseDelayMs int `toml:"base_delay_ms,omitempty" mapstructure:"base_delay_ms"`
+	MaxDelayMs  int `toml:"max_delay_ms,omitempty" mapstructure:"max_delay_ms"`
+}
+
+var DefaultPolicy = Policy{
+	MaxAttempts: 3,
+	BaseDelayMs: 500,
+	MaxDelayMs:  30 * 1000,
+}
+
+// Merge fills zero fields of p with the ones of fallback
+func (p Policy) Merge(fallback Policy) Policy {
+	if p.MaxAttempts == 0 {
+		p.MaxAttempts = fallback.MaxAttempts
+	}
+	if p.BaseDelayMs == 0 {
+		p.BaseDelayMs = fallback.BaseDelayMs
+	}
+	if p.MaxDelayMs == 0 {
+		p.MaxDelayMs = fallback.MaxDelayMs
+	}
+	return p
+}
+
+// backoff returns exponential delay with jitter before the next attempt
+func (p Policy) backoff(attempt int) time.Duration {
+	base := time.Duration(p.BaseDelayMs) * time.Millisecond
+	max := time.Duration(p.MaxDelayMs) * time.Millisecond
+	d := base << (attempt - 1)
+	if d <= 0 || d > max {
+		d = max
+	}
+	if d <= 0 {
+		return 0
+	}
+	// equal jitter: keep half of the delay, randomize the other half
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
+
+// Error is an error classified as retryable or fatal
+type Error struct {
+	Err        error
+	Retryable  bool
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Retryable marks err as worth another attempt, after at least the given delay
+func Retryable(err error, after time.Duration) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Err: err, Retryable: true, RetryAfter: after}
+}
+
+// Fatal marks err as not worth another attempt
+func Fatal(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Err: err}
+}
+
+// IsRetryable reports whether err is worth another attempt, and how long to
+// wait at least before it. Errors not classified by Retryable or Fatal are
+// retryable only if they come from the network.
+func IsRetryable(err error) (bool, time.Duration) {
+	if err == nil {
+		return false, 0
+	}
+	var classified *Error
+	if errors.As(err, &classified) {
+		return classified.Retryable, classified.RetryAfter
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false, 0
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true, 0
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) {
+		return true, 0
+	}
+	return false, 0
+}
+
+// CheckResponse returns nil for a 2xx response, otherwise a classified error
+// describing it
+func CheckResponse(resp *http.Response, body []byte) error {
+	if 200 <= resp.StatusCode && resp.StatusCode < 300 {
+		return nil
+	}
+	err := fmt.Errorf("unexpected status code %d. response: %s", resp.StatusCode, string(body))
+	return ClassifyStatus(resp.StatusCode, resp.Header, body, err)
+}
+
+// ClassifyStatus classifies err caused by a http response with given status
+// code. header and body are optional and only used to detect rate limiting.
+func ClassifyStatus(statusCode int, header http.Header, body []byte, err error) error {
+	switch {
+	case statusCode == http.StatusTooManyRequests:
+		return Retryable(err, retryAfter(header))
+	case statusCode == http.StatusForbidden && isRateLimited(header, body):
+		return Retryable(err, retryAfter(header))
+	case statusCode == http.StatusRequestTimeout || statusCode >= 500:
+		return Retryable(err, retryAfter(header))
+	default:
+		return Fatal(err)
+	}
+}
+
+// isRateLimited detects GitHub primary and secondary rate limit responses
+func isRateLimited(header http.Header, body []byte) bool {
+	if header != nil {
+		if header.Get("Retry-After") != "" || header.Get("X-RateLimit-Remaining") == "0" {
+			return true
+		}
+	}
+	return strings.Contains(strings.ToLower(string(body)), "secondary rate limit")
+}
+
+// retryAfter reads the delay asked by server from Retry-After or
+// X-RateLimit-Reset header
+func retryAfter(header http.Header) time.Duration {
+	if header == nil {
+		return 0
+	}
+	if v := header.Get("Retry-After"); v != "" {
+		if secs, err := strconv.Atoi(v); err == nil {
+			return time.Duration(secs) * time.Second
+		}
+		if t, err := http.ParseTime(v); err == nil {
+			return time.Until(t)
+		}
+	}
+	if header.Get("X-RateLimit-Remaining") == "0" {
+		if reset, err := strconv.ParseInt(header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+			return time.Until(time.Unix(reset, 0))
+		}
+	}
+	return 0
+}
+
+// Do calls fn until it succeeds, fails with a non-retryable error, the
+// attempts of policy are used up or ctx is done. It returns how many attempts
+// were made. A server asking to wait longer than MaxDelayMs is not retried.
+func Do(ctx context.Context, policy Policy, fn func() error) (attempts int, err error) {
+	policy = policy.Merge(DefaultPolicy)
+	for attempts = 1; ; attempts++ {
+		err = fn()
+		if err == nil {
+			return
+		}
+		retryable, after := IsRetryable(err)
+		if !retryable || attempts >= policy.MaxAttempts {
+			return
+		}
+		if after > time.Duration(policy.MaxDelayMs)*time.Millisecond {
+			xlog.GVerbose.Info("attempt %d failed: %s. server asks to wait %s, giving up", attempts, err.Error(), after)
+			return
+		}
+		delay := policy.backoff(attempts)
+		if after > delay {
+			delay = after
+		}
+		xlog.GVerbose.Info("attempt %d failed: %s. retrying in %s", attempts, err.Error(), delay)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return attempts, ctx.Err()
+		}
+	}
+}
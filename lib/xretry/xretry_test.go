@@ -0,0 +1,84 @@
+package xretry
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCheckResponse(t *testing.T) {
+	resetAt := strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10)
+	tests := []struct {
+		name          string
+		status        int
+		header        http.Header
+		body          string
+		wantErr       bool
+		wantRetryable bool
+		wantAfter     bool
+	}{
+		{"ok", 201, nil, "", false, false, false},
+		{"not found", 404, nil, "", true, false, false},
+		{"bad gateway", 502, nil, "", true, true, false},
+		{"too many requests", 429, http.Header{"Retry-After": {"3"}}, "", true, true, true},
+		{"github secondary rate limit", 403, nil, `{"message":"You have exceeded a secondary rate limit"}`, true, true, false},
+		{"github primary rate limit", 403, http.Header{"X-Ratelimit-Remaining": {"0"}, "X-Ratelimit-Reset": {resetAt}}, "", true, true, true},
+		{"forbidden", 403, nil, `{"message":"Bad credentials"}`, true, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: tt.status, Header: tt.header}
+			err := CheckResponse(resp, []byte(tt.body))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CheckResponse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			retryable, after := IsRetryable(err)
+			if retryable != tt.wantRetryable {
+				t.Errorf("IsRetryable() = %v, want %v", retryable, tt.wantRetryable)
+			}
+			if (after > 0) != tt.wantAfter {
+				t.Errorf("IsRetryable() after = %v, want positive %v", after, tt.wantAfter)
+			}
+		})
+	}
+}
+
+func TestDo(t *testing.T) {
+	policy := Policy{MaxAttempts: 4, BaseDelayMs: 1, MaxDelayMs: 2}
+
+	calls := 0
+	attempts, err := Do(context.Background(), policy, func() error {
+		calls++
+		if calls < 3 {
+			return Retryable(errors.New("temporary"), 0)
+		}
+		return nil
+	})
+	if err != nil || attempts != 3 {
+		t.Errorf("Do() = %d, %v, want 3, nil", attempts, err)
+	}
+
+	attempts, err = Do(context.Background(), policy, func() error {
+		return Fatal(errors.New("fatal"))
+	})
+	if err == nil || attempts != 1 {
+		t.Errorf("Do() = %d, %v, want 1, error", attempts, err)
+	}
+
+	attempts, err = Do(context.Background(), policy, func() error {
+		return Retryable(errors.New("temporary"), 0)
+	})
+	if err == nil || attempts != policy.MaxAttempts {
+		t.Errorf("Do() = %d, %v, want %d, error", attempts, err, policy.MaxAttempts)
+	}
+
+	attempts, _ = Do(context.Background(), policy, func() error {
+		return Retryable(errors.New("rate limited"), time.Hour)
+	})
+	if attempts != 1 {
+		t.Errorf("Do() = %d, want 1 when server asks to wait longer than max delay", attempts)
+	}
+}
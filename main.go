@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -8,6 +9,7 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"runtime"
 	"strings"
@@ -15,14 +17,17 @@ import (
 	"time"
 
 	"github.com/alexflint/go-arg"
+	"github.com/mattn/go-isatty"
 	"github.com/pelletier/go-toml/v2"
 	"github.com/pluveto/upgit/lib/aliyunoss"
 	"github.com/pluveto/upgit/lib/model"
 	"github.com/pluveto/upgit/lib/qcloudcos"
+	"github.com/pluveto/upgit/lib/qiniu"
 	"github.com/pluveto/upgit/lib/result"
 	"github.com/pluveto/upgit/lib/s3"
 	"github.com/pluveto/upgit/lib/uploaders"
 	"github.com/pluveto/upgit/lib/upyun"
+	"github.com/pluveto/upgit/lib/webdav"
 	"github.com/pluveto/upgit/lib/xapp"
 	"github.com/pluveto/upgit/lib/xclipboard"
 	"github.com/pluveto/upgit/lib/xext"
@@ -32,6 +37,7 @@ import (
 	"github.com/pluveto/upgit/lib/xlog"
 	"github.com/pluveto/upgit/lib/xmap"
 	"github.com/pluveto/upgit/lib/xpath"
+	"github.com/pluveto/upgit/lib/xprogress"
 	"github.com/pluveto/upgit/lib/xstrings"
 	"github.com/pluveto/upgit/lib/xzip"
 	"golang.design/x/clipboard"
@@ -44,6 +50,14 @@ func main() {
 		extSubcommand()
 		return
 	}
+	if len(os.Args) >= 2 && os.Args[1] == "abort-multipart" {
+		abortMultipartSubcommand()
+		return
+	}
+	if len(os.Args) >= 2 && os.Args[1] == "upyun" {
+		upyunSubcommand()
+		return
+	}
 	mainCommand()
 }
 
@@ -59,12 +73,29 @@ func mainCommand() {
 
 	// handle clipboard if need
 	handleClipboard()
+	defer removeTempFiles()
+	handleTextInputs()
 
 	// validating args
 	validArgs()
 
+	// cancel uploading on SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		// a second signal kills the process at once
+		stop()
+	}()
+
+	ctx = withProgress(ctx)
+
 	// executing uploading
-	dispatchUploader()
+	dispatchUploader(ctx)
+	if ctx.Err() != nil {
+		removeTempFiles()
+		os.Exit(130)
+	}
 
 	if xapp.AppOpt.Wait {
 		fmt.Scanln()
@@ -94,9 +125,48 @@ func loadCliOpts() {
 	xlog.GVerbose.TraceStruct(xapp.AppOpt)
 }
 
+// progressBar is set when progress is drawn as bars on terminal
+var progressBar *xprogress.BarReporter
+
+// withProgress returns a context delivering upload progress as asked by --progress
+func withProgress(ctx context.Context) context.Context {
+	mode := xapp.AppOpt.Progress
+	if mode == "auto" {
+		mode = "none"
+		if isatty.IsTerminal(os.Stderr.Fd()) || isatty.IsCygwinTerminal(os.Stderr.Fd()) {
+			mode = "bar"
+		}
+	}
+	switch mode {
+	case "bar":
+		progressBar = &xprogress.BarReporter{W: os.Stderr}
+		return xprogress.WithReporter(ctx, progressBar)
+	case "json":
+		return xprogress.WithReporter(ctx, &xprogress.JSONReporter{W: os.Stderr})
+	case "none", "":
+		return ctx
+	default:
+		xlog.AbortErr(errors.New("unknown progress output: " + mode))
+		return ctx
+	}
+}
+
 func onUploaded(r result.Result[*model.Task]) {
-	if !r.Ok() && xapp.AppOpt.OutputType == xapp.O_Stdout {
-		fmt.Println("Failed: " + r.Err.Error())
+	if progressBar != nil {
+		progressBar.Clear()
+	}
+	if !r.Ok() {
+		// keep one output line per input file, so that editors could map them
+		if xapp.AppOpt.OutputType == xapp.O_Stdout {
+			if r.Value != nil && r.Value.Status == model.TASK_PAUSED {
+				fmt.Println("Paused: " + r.Err.Error())
+			} else {
+				fmt.Println("Failed: " + r.Err.Error())
+			}
+		}
+		if r.Value != nil {
+			recordHistory(*r.Value, r.Err)
+		}
 		return
 	}
 	if xapp.AppOpt.Clean && !r.Value.Ignored {
@@ -109,7 +179,7 @@ func onUploaded(r result.Result[*model.Task]) {
 
 	}
 	outputLink(*r.Value)
-	recordHistory(*r.Value)
+	recordHistory(*r.Value, nil)
 }
 
 func mustMarshall(s interface{}) string {
@@ -120,10 +190,39 @@ func mustMarshall(s interface{}) string {
 	return string(b)
 }
 
-func recordHistory(r model.Task) {
-	xio.AppendToFile(xpath.MustGetApplicationPath("history.log"), []byte(
-		`{"time":"`+time.Now().Local().String()+`","rawUrl":"`+r.RawUrl+`","url":"`+r.Url+`"}`+"\n"),
-	)
+// historyEntry is a line of history.log
+type historyEntry struct {
+	Time      string             `json:"time"`
+	RawUrl    string             `json:"rawUrl"`
+	Url       string             `json:"url"`
+	LocalPath string             `json:"localPath,omitempty"`
+	Status    model.UploadStatus `json:"status,omitempty"`
+	Error     string             `json:"error,omitempty"`
+	// ExpireTime is set when the url is presigned
+	ExpireTime string `json:"expireTime,omitempty"`
+	// Repo is set by uploaders to git repositories
+	Repo string `json:"repo,omitempty"`
+}
+
+func recordHistory(r model.Task, uploadErr error) {
+	entry := historyEntry{
+		Time:      time.Now().Local().String(),
+		RawUrl:    r.RawUrl,
+		Url:       r.Url,
+		LocalPath: r.LocalPath,
+		Status:    r.Status,
+		Repo:      r.Repo,
+	}
+	if uploadErr != nil {
+		entry.Error = uploadErr.Error()
+	}
+	if !r.ExpireTime.IsZero() {
+		entry.ExpireTime = r.ExpireTime.Local().String()
+	}
+	line, err := json.Marshal(entry)
+	if err == nil {
+		xio.AppendToFile(xpath.MustGetApplicationPath("history.log"), append(line, '\n'))
+	}
 
 	xlog.GVerbose.Info(mustMarshall(r))
 }
@@ -158,6 +257,7 @@ func outputFormat(r model.Task) (content string, err error) {
 	}
 	content = strings.NewReplacer(
 		"{url}", outUrl,
+		"{rawurl}", r.RawUrl,
 		"{urlfname}", filepath.Base(outUrl),
 		"{fname}", filepath.Base(r.LocalPath),
 	).Replace(xstrings.RemoveFmtUnderscore(val))
@@ -248,73 +348,264 @@ func loadConfig(cfg *xapp.Config) {
 
 // UploadAll will upload all given file to targetDir.
 // If targetDir is not set, it will upload using rename rules.
-func UploadAll(uploader model.Uploader, localPaths []string, targetDir string, callback func(result.Result[*model.Task])) {
-	for taskId, localPath := range localPaths {
-
-		var ret result.Result[*model.Task]
-		task := model.Task{
-			Status:     model.TASK_CREATED,
-			TaskId:     taskId,
-			LocalPath:  localPath,
-			TargetDir:  targetDir,
-			RawUrl:     "",
-			Url:        "",
-			CreateTime: time.Now(),
+// At most concurrency files are uploaded at the same time, but callback is
+// always invoked in the order of localPaths.
+// Once ctx is done, in-flight tasks are cancelled and pending ones paused.
+// For a model.BatchUploader, callback is invoked after all tasks are flushed.
+func UploadAll(ctx context.Context, uploader model.Uploader, localPaths []string, targetDir string, concurrency int, callback func(result.Result[*model.Task])) (rets []result.Result[*model.Task]) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	results := make([]chan result.Result[*model.Task], len(localPaths))
+	for i := range results {
+		results[i] = make(chan result.Result[*model.Task], 1)
+	}
+	slots := make(chan struct{}, concurrency)
+	go func() {
+		for taskId, localPath := range localPaths {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				results[taskId] <- pausedTask(taskId, localPath, targetDir, ctx.Err())
+				continue
+			}
+			go func(taskId int, localPath string) {
+				defer func() { <-slots }()
+				results[taskId] <- uploadOne(ctx, uploader, taskId, localPath, targetDir)
+			}(taskId, localPath)
 		}
-		var err error
-		// ignore non-local path
-		if strings.HasPrefix(localPath, "http") {
-			task.Ignored = true
-			task.Status = model.TASK_FINISHED
-		} else {
-			err = uploader.Upload(&task)
+	}()
+	batch, isBatch := uploader.(model.BatchUploader)
+	for _, ch := range results {
+		ret := <-ch
+		rets = append(rets, ret)
+		if nil != callback && !isBatch {
+			callback(ret)
 		}
-		if err != nil {
-			task.Status = model.TASK_FAILED
-			ret = result.Result[*model.Task]{
-				Err: err,
-			}
-		} else {
-			ret = result.Result[*model.Task]{
-				Value: &task,
+	}
+	if isBatch {
+		flushBatch(ctx, batch, rets)
+		for _, ret := range rets {
+			if nil != callback {
+				callback(ret)
 			}
 		}
+	}
+	return
+}
 
-		if err == nil {
-			xlog.GVerbose.TraceStruct(ret.Value)
+// flushBatch publishes tasks staged by uploader. If it fails, every staged
+// task fails with the error, while tasks finished without staging are kept.
+func flushBatch(ctx context.Context, uploader model.BatchUploader, rets []result.Result[*model.Task]) {
+	staged, err := uploader.Flush(ctx)
+	if err == nil {
+		return
+	}
+	failed := make(map[*model.Task]bool)
+	for _, task := range staged {
+		failed[task] = true
+	}
+	for i, ret := range rets {
+		if task := ret.Value; failed[task] {
+			task.Status = model.TASK_FAILED
+			rets[i].Err = fmt.Errorf("%s: %w", task.LocalPath, err)
 		}
-		if nil != callback {
-			callback(ret)
+	}
+}
+
+func newTask(taskId int, localPath, targetDir string) model.Task {
+	return model.Task{
+		Status:     model.TASK_CREATED,
+		TaskId:     taskId,
+		LocalPath:  localPath,
+		TargetDir:  targetDir,
+		RawUrl:     "",
+		Url:        "",
+		CreateTime: time.Now(),
+	}
+}
+
+// pausedTask is the result of a task never started because of cancellation
+func pausedTask(taskId int, localPath, targetDir string, cause error) result.Result[*model.Task] {
+	task := newTask(taskId, localPath, targetDir)
+	task.Status = model.TASK_PAUSED
+	return result.Result[*model.Task]{
+		Value: &task,
+		Err:   fmt.Errorf("%s: not started: %w", localPath, cause),
+	}
+}
+
+func uploadOne(ctx context.Context, uploader model.Uploader, taskId int, localPath, targetDir string) (ret result.Result[*model.Task]) {
+	if ctx.Err() != nil {
+		return pausedTask(taskId, localPath, targetDir, ctx.Err())
+	}
+	task := newTask(taskId, localPath, targetDir)
+	ctx = xprogress.WithTask(ctx, taskId, filepath.Base(localPath))
+	var err error
+	// ignore non-local path
+	if strings.HasPrefix(localPath, "http") {
+		task.Ignored = true
+		task.Status = model.TASK_FINISHED
+	} else {
+		err = model.UploadContext(ctx, uploader, &task)
+	}
+	if err != nil {
+		task.Status = model.TASK_FAILED
+		ret = result.Result[*model.Task]{
+			Value: &task,
+			Err:   fmt.Errorf("%s: %w", localPath, err),
 		}
+	} else {
+		ret = result.Result[*model.Task]{
+			Value: &task,
+		}
+	}
+
+	if err == nil {
+		xlog.GVerbose.TraceStruct(ret.Value)
 	}
+	return
 }
 
-func dispatchUploader() {
+// getConcurrency returns how many files could be uploaded in parallel,
+// cli option takes precedence over config
+func getConcurrency() int {
+	if xapp.AppOpt.Jobs > 0 {
+		return xapp.AppOpt.Jobs
+	}
+	if xapp.AppCfg.Concurrency > 0 {
+		return xapp.AppCfg.Concurrency
+	}
+	return 1
+}
+
+func dispatchUploader(ctx context.Context) {
 	uploaderId := xstrings.ValueOrDefault(xapp.AppOpt.Uploader, xapp.AppCfg.DefaultUploader)
 	xlog.GVerbose.Info("uploader: " + uploaderId)
+	uploader := loadUploader(uploaderId)
+	rets := UploadAll(ctx, uploader, xapp.AppOpt.LocalPaths, xapp.AppOpt.TargetDir, getConcurrency(), onUploaded)
+	if ctx.Err() != nil {
+		printSummary(rets)
+	}
+}
+
+// printSummary prints how many tasks are finished, failed or paused
+func printSummary(rets []result.Result[*model.Task]) {
+	if progressBar != nil {
+		progressBar.Clear()
+	}
+	var finished, failed, paused int
+	for _, ret := range rets {
+		switch {
+		case ret.Ok():
+			finished++
+		case ret.Value != nil && ret.Value.Status == model.TASK_PAUSED:
+			paused++
+		default:
+			failed++
+		}
+	}
+	fmt.Fprintf(os.Stderr, "interrupted: %d uploaded, %d failed, %d not started\n", finished, failed, paused)
+}
+
+// presignSupported lists uploaders able to make presigned urls
+var presignSupported = map[string]bool{
+	"s3":        true,
+	"aliyunoss": true,
+	"qcloudcos": true,
+	"qiniu":     true,
+}
+
+// loadUploader creates uploader by id, either built-in or from extensions dir
+func loadUploader(uploaderId string) model.Uploader {
+	opts, err := xapp.LoadUploaderOptions(uploaderId)
+	xlog.AbortErr(err)
+	xlog.GVerbose.TraceStruct(&opts)
+	xlog.AbortErr(opts.Validate())
+	if presigned, _ := opts.Presigned(); presigned && !presignSupported[uploaderId] {
+		xlog.AbortErr(errors.New("uploader " + uploaderId + " doesn't support url_mode " + xapp.URLModePresigned))
+	}
 	if uploaderId == "github" {
 		gCfg, err := xapp.LoadUploaderConfig[uploaders.GithubUploaderConfig](uploaderId)
 		xlog.AbortErr(err)
 		err = validator.Validate(&gCfg)
 		xlog.AbortErr(err)
+		xlog.AbortErr(gCfg.Validate())
 		if len(gCfg.Branch) == 0 {
 			gCfg.Branch = xapp.DefaultBranch
 		}
 
-		uploader := uploaders.GithubUploader{Config: gCfg}
-		UploadAll(uploader, xapp.AppOpt.LocalPaths, xapp.AppOpt.TargetDir, onUploaded)
-		return
+		uploader := &uploaders.GithubUploader{Config: gCfg, Options: opts}
+		if gCfg.Mode == uploaders.GithubModeGitData {
+			return uploaders.GithubBatchUploader{GithubUploader: uploader}
+		}
+		return uploader
+	}
+	if uploaderId == "github-release" {
+		// credentials not set are shared with [uploaders.github]
+		rCfg, err := xapp.LoadUploaderConfig[uploaders.GithubReleaseConfig](uploaderId)
+		xlog.AbortErr(err)
+		gCfg, err := xapp.LoadUploaderConfig[uploaders.GithubUploaderConfig]("github")
+		xlog.AbortErr(err)
+		rCfg.Inherit(gCfg)
+		err = validator.Validate(&rCfg)
+		xlog.AbortErr(err)
+		xlog.AbortErr(rCfg.Validate())
+		return uploaders.NewGithubReleaseUploader(rCfg, opts)
+	}
+	if uploaderId == "gist" {
+		// credentials not set are shared with [uploaders.github]
+		gistCfg, err := xapp.LoadUploaderConfig[uploaders.GistConfig](uploaderId)
+		xlog.AbortErr(err)
+		gCfg, err := xapp.LoadUploaderConfig[uploaders.GithubUploaderConfig]("github")
+		xlog.AbortErr(err)
+		gistCfg.Inherit(gCfg)
+		err = validator.Validate(&gistCfg)
+		xlog.AbortErr(err)
+		return uploaders.NewGistUploader(gistCfg, opts)
+	}
+	if uploaderId == "git" {
+		gitCfg, err := xapp.LoadUploaderConfig[uploaders.GitConfig](uploaderId)
+		xlog.AbortErr(err)
+		err = validator.Validate(&gitCfg)
+		xlog.AbortErr(err)
+		xlog.AbortErr(gitCfg.Validate())
+		return &uploaders.GitUploader{Config: gitCfg, Options: opts}
+	}
+	if uploaderId == "gitea" {
+		gCfg, err := xapp.LoadUploaderConfig[uploaders.GiteaConfig](uploaderId)
+		xlog.AbortErr(err)
+		err = validator.Validate(&gCfg)
+		xlog.AbortErr(err)
+		xlog.AbortErr(gCfg.Validate())
+		return uploaders.NewGiteaUploader(gCfg, opts)
+	}
+	if uploaderId == "gitlab" {
+		gCfg, err := xapp.LoadUploaderConfig[uploaders.GitlabConfig](uploaderId)
+		xlog.AbortErr(err)
+		err = validator.Validate(&gCfg)
+		xlog.AbortErr(err)
+		xlog.AbortErr(gCfg.Validate())
+		return uploaders.NewGitlabUploader(gCfg, opts)
 	}
 	if uploaderId == "qcloudcos" {
 		qCfg, err := xapp.LoadUploaderConfig[qcloudcos.COSConfig](uploaderId)
 		xlog.AbortErr(err)
 		err = validator.Validate(&qCfg)
 		xlog.AbortErr(err)
+		xlog.AbortErr(qCfg.Validate())
 		xlog.GVerbose.Trace("qcloudcos config: ")
 		xlog.GVerbose.TraceStruct(&qCfg)
-		uploader := qcloudcos.COSUploader{Config: qCfg}
-		UploadAll(uploader, xapp.AppOpt.LocalPaths, xapp.AppOpt.TargetDir, onUploaded)
-		return
+		uploader := qcloudcos.COSUploader{Config: qCfg, Options: opts}
+		return uploader
+	}
+	if uploaderId == "webdav" {
+		wCfg, err := xapp.LoadUploaderConfig[webdav.WebdavConfig](uploaderId)
+		xlog.AbortErr(err)
+		err = validator.Validate(&wCfg)
+		xlog.AbortErr(err)
+		xlog.AbortErr(wCfg.Validate())
+		return webdav.NewWebdavUploader(wCfg, opts)
 	}
 	if uploaderId == "upyun" {
 		ucfg, err := xapp.LoadUploaderConfig[upyun.UpyunConfig](uploaderId)
@@ -323,9 +614,8 @@ func dispatchUploader() {
 		xlog.AbortErr(err)
 		xlog.GVerbose.Trace("upyun config: ")
 		xlog.GVerbose.TraceStruct(&ucfg)
-		uploader := upyun.UpyunUploader{Config: ucfg}
-		UploadAll(uploader, xapp.AppOpt.LocalPaths, xapp.AppOpt.TargetDir, onUploaded)
-		return
+		uploader := upyun.UpyunUploader{Config: ucfg, Options: opts}
+		return uploader
 	}
 	if uploaderId == "s3" {
 		ucfg, err := xapp.LoadUploaderConfig[s3.S3Config](uploaderId)
@@ -334,10 +624,25 @@ func dispatchUploader() {
 		xlog.AbortErr(err)
 		xlog.GVerbose.Trace("s3 config: ")
 		xlog.GVerbose.TraceStruct(&ucfg)
-		uploader, err := s3.NewS3Uploader(ucfg)
+		uploader, err := s3.NewS3Uploader(ucfg, opts)
 		xlog.AbortErr(err)
-		UploadAll(uploader, xapp.AppOpt.LocalPaths, xapp.AppOpt.TargetDir, onUploaded)
-		return
+		return uploader
+	}
+	if uploaderId == "qiniu" {
+		qCfg, err := xapp.LoadUploaderConfig[qiniu.QiniuConfig](uploaderId)
+		xlog.AbortErr(err)
+		// configs with only a pre-generated token are handled by extensions/qiniu.jsonc
+		if len(qCfg.AccessKey) > 0 {
+			err = validator.Validate(&qCfg)
+			xlog.AbortErr(err)
+			xlog.GVerbose.Trace("qiniu config: ")
+			xlog.GVerbose.TraceStruct(&qCfg)
+			uploader := qiniu.QiniuUploader{Config: qCfg, Options: opts}
+			return uploader
+		}
+		if presigned, _ := opts.Presigned(); presigned {
+			xlog.AbortErr(errors.New("qiniu: url_mode " + xapp.URLModePresigned + " requires access_key and secret_key"))
+		}
 	}
 	if uploaderId == "aliyunoss" {
 		aCfg, err := xapp.LoadUploaderConfig[aliyunoss.OSSConfig](uploaderId)
@@ -346,9 +651,8 @@ func dispatchUploader() {
 		xlog.AbortErr(err)
 		xlog.GVerbose.Trace("aliyunoss config: ")
 		xlog.GVerbose.TraceStruct(&aCfg)
-		uploader := aliyunoss.OSSUploader{Config: aCfg}
-		UploadAll(uploader, xapp.AppOpt.LocalPaths, xapp.AppOpt.TargetDir, onUploaded)
-		return
+		uploader := aliyunoss.OSSUploader{Config: aCfg, Options: opts}
+		return uploader
 	}
 	// try http simple uploader
 	// list file in ./extensions
@@ -372,7 +676,7 @@ func dispatchUploader() {
 		if result.From[string](xmap.GetDeep[string](uploaderDef, "meta.type")).ValueOrExit() != "simple-http-uploader" {
 			continue
 		}
-		uploader = &uploaders.SimpleHttpUploader{Definition: uploaderDef}
+		uploader = &uploaders.SimpleHttpUploader{Definition: uploaderDef, Options: opts}
 		extConfig, err := xapp.LoadUploaderConfig[map[string]interface{}](uploaderId)
 		if err == nil {
 			uploader.Config = extConfig
@@ -386,8 +690,52 @@ func dispatchUploader() {
 	if nil == uploader {
 		xlog.AbortErr(errors.New("unknown uploader: " + uploaderId))
 	}
-	UploadAll(uploader, xapp.AppOpt.LocalPaths, xapp.AppOpt.TargetDir, onUploaded)
+	return uploader
+}
+
+// tempFiles are created by upgit itself and removed before exiting
+var tempFiles []string
+
+func removeTempFiles() {
+	for _, path := range tempFiles {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			xlog.GVerbose.Info("Failed to remove %s: %s", path, err.Error())
+		}
+	}
+}
 
+// handleTextInputs saves stdin ("-") and clipboard text into temp files to
+// upload
+func handleTextInputs() {
+	for i, path := range xapp.AppOpt.LocalPaths {
+		var name string
+		var buf []byte
+		switch strings.ToLower(path) {
+		case xapp.StdinPlaceholder:
+			var err error
+			buf, err = ioutil.ReadAll(os.Stdin)
+			xlog.AbortErr(err)
+			name = "stdin.txt"
+		case xapp.ClipboardTextPlaceholder:
+			if err := clipboard.Init(); err != nil {
+				xlog.AbortErr(fmt.Errorf("failed to init clipboard: " + err.Error()))
+			}
+			buf = clipboard.Read(clipboard.FmtText)
+			if len(buf) == 0 {
+				xlog.AbortErr(errors.New("failed: no text in clipboard"))
+			}
+			name = "clipboard.txt"
+		default:
+			continue
+		}
+		// a dir of its own keeps the file name, which gists show
+		dir, err := os.MkdirTemp("", "upgit_tmp_")
+		xlog.AbortErr(err)
+		tmpFileName := filepath.Join(dir, name)
+		xlog.AbortErr(os.WriteFile(tmpFileName, buf, 0600))
+		tempFiles = append(tempFiles, tmpFileName, dir)
+		xapp.AppOpt.LocalPaths[i] = tmpFileName
+	}
 }
 
 func handleClipboard() {
@@ -414,6 +762,7 @@ func handleClipboard() {
 				xlog.AbortErr(fmt.Errorf("failed: no image in clipboard or unsupported format"))
 			}
 			os.WriteFile(tmpFileName, buf, os.FileMode(fs.ModePerm))
+			tempFiles = append(tempFiles, tmpFileName)
 			xapp.AppOpt.LocalPaths[0] = tmpFileName
 			xapp.AppOpt.Clean = true
 		}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/alexflint/go-arg"
+	"github.com/pluveto/upgit/lib/xapp"
+	"github.com/pluveto/upgit/lib/xlog"
+	"github.com/pluveto/upgit/lib/xpath"
+	"github.com/pluveto/upgit/lib/xstrings"
+)
+
+type AbortMultipartCmd struct {
+	Uploader        string `arg:"-u,--uploader"      help:"uploader to use. if not set, will follow config"`
+	All             bool   `arg:"--all"              help:"abort every unfinished upload in bucket, not only the ones started on this machine"`
+	ConfigFile      string `arg:"-c,--config-file"   help:"when set, will use specific config file"`
+	Verbose         bool   `arg:"-V,--verbose"       help:"when set, output more details to help developers"`
+	ApplicationPath string `arg:"--application-path" help:"custom application path, which determines config file path and extensions dir path. current binary dir by default"`
+}
+
+type AbortMultipartArgs struct {
+	AbortMultipart *AbortMultipartCmd `arg:"subcommand:abort-multipart" help:"abort unfinished multipart uploads, so that storage isn't charged for their parts"`
+}
+
+// multipartAborter is implemented by uploaders supporting resumable multipart upload
+type multipartAborter interface {
+	AbortMultipart(ctx context.Context, all bool) (aborted []string, err error)
+}
+
+var abortMultipartArgs AbortMultipartArgs
+
+func abortMultipartSubcommand() {
+	arg.MustParse(&abortMultipartArgs)
+	cmd := abortMultipartArgs.AbortMultipart
+
+	xapp.AppOpt.ConfigFile = cmd.ConfigFile
+	xlog.GVerbose.VerboseEnabled = cmd.Verbose
+	if applicationPath := strings.Trim(cmd.ApplicationPath, "/"); len(applicationPath) > 0 {
+		xpath.ApplicationPath = applicationPath
+	}
+	loadEnvConfig(&xapp.AppCfg)
+	loadConfig(&xapp.AppCfg)
+
+	uploaderId := xstrings.ValueOrDefault(cmd.Uploader, xapp.AppCfg.DefaultUploader)
+	aborter, ok := loadUploader(uploaderId).(multipartAborter)
+	if !ok {
+		xlog.AbortErr(errors.New("uploader " + uploaderId + " has no multipart upload to abort"))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	aborted, err := aborter.AbortMultipart(ctx, cmd.All)
+	for _, upload := range aborted {
+		fmt.Println("Aborted:", upload)
+	}
+	xlog.AbortErr(err)
+	if len(aborted) == 0 {
+		fmt.Println("No unfinished upload")
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/alexflint/go-arg"
+	"github.com/pluveto/upgit/lib/upyun"
+	"github.com/pluveto/upgit/lib/xapp"
+	"github.com/pluveto/upgit/lib/xhttp"
+	"github.com/pluveto/upgit/lib/xlog"
+	"github.com/pluveto/upgit/lib/xpath"
+)
+
+type UpyunLsCmd struct {
+	Dir       string `arg:"positional" default:"/" help:"directory in bucket"`
+	Recursive bool   `arg:"-r,--recursive"         help:"list subdirectories too"`
+}
+
+type UpyunRmCmd struct {
+	Paths []string `arg:"positional,required" help:"paths in bucket or urls of uploaded files"`
+}
+
+type UpyunUsageCmd struct {
+}
+
+type UpyunCmd struct {
+	Ls    *UpyunLsCmd    `arg:"subcommand:ls" help:"list files in bucket"`
+	Rm    *UpyunRmCmd    `arg:"subcommand:rm" help:"delete files from bucket"`
+	Usage *UpyunUsageCmd `arg:"subcommand:usage" help:"show storage used by bucket"`
+
+	ConfigFile      string `arg:"-c,--config-file"   help:"when set, will use specific config file"`
+	Verbose         bool   `arg:"-V,--verbose"       help:"when set, output more details to help developers"`
+	ApplicationPath string `arg:"--application-path" help:"custom application path, which determines config file path and extensions dir path. current binary dir by default"`
+}
+
+type UpyunArgs struct {
+	Upyun *UpyunCmd `arg:"subcommand:upyun" help:"manage files uploaded to upyun"`
+}
+
+var upyunArgs UpyunArgs
+
+func upyunSubcommand() {
+	p := arg.MustParse(&upyunArgs)
+	cmd := upyunArgs.Upyun
+	if cmd.Ls == nil && cmd.Rm == nil && cmd.Usage == nil {
+		p.Fail("missing subcommand: ls, rm or usage")
+	}
+
+	xapp.AppOpt.ConfigFile = cmd.ConfigFile
+	xlog.GVerbose.VerboseEnabled = cmd.Verbose
+	if applicationPath := strings.Trim(cmd.ApplicationPath, "/"); len(applicationPath) > 0 {
+		xpath.ApplicationPath = applicationPath
+	}
+	loadEnvConfig(&xapp.AppCfg)
+	loadConfig(&xapp.AppCfg)
+
+	uploader, ok := loadUploader("upyun").(upyun.UpyunUploader)
+	if !ok {
+		xlog.AbortErr(errors.New("upyun is not configured"))
+	}
+	client := uploader.Client()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	switch {
+	case cmd.Ls != nil:
+		xlog.AbortErr(upyunList(ctx, client, cmd.Ls.Dir, cmd.Ls.Recursive))
+
+	case cmd.Rm != nil:
+		failed := false
+		for _, p := range cmd.Rm.Paths {
+			p = upyunPathOf(p, uploader.Config.Host)
+			if err := client.Delete(ctx, p); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed: %s: %s\n", p, err)
+				failed = true
+				continue
+			}
+			fmt.Println("Deleted:", p)
+		}
+		if failed {
+			os.Exit(1)
+		}
+
+	case cmd.Usage != nil:
+		used, err := client.Usage(ctx)
+		xlog.AbortErr(err)
+		fmt.Println(xhttp.HumanizeBytes(uint64(used)))
+	}
+}
+
+// upyunList prints files in dir, one per line as "date size path"
+func upyunList(ctx context.Context, client *upyun.Client, dir string, recursive bool) error {
+	files, err := client.List(ctx, dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		p := path.Join("/", dir, f.Name)
+		date := fmt.Sprintf("%-16s", "-")
+		if f.LastModified > 0 {
+			date = time.Unix(f.LastModified, 0).Format("2006-01-02 15:04")
+		}
+		if f.IsDir() {
+			fmt.Printf("%s %10s %s/\n", date, "-", p)
+			if recursive {
+				if err := upyunList(ctx, client, p, true); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		fmt.Printf("%s %10s %s\n", date, xhttp.HumanizeBytes(uint64(f.Length)), p)
+	}
+	return nil
+}
+
+// upyunPathOf converts an url of uploaded file back to its path in bucket
+func upyunPathOf(s, host string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" || u.Host != host {
+		return s
+	}
+	p := u.Path
+	// strip content secret, see upyun.UpyunConfig.ContentSecret
+	if i := strings.LastIndex(p, "!"); i > strings.LastIndex(p, "/") {
+		p = p[:i]
+	}
+	return p
+}